@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ackIndexMaxEntries limita quantos fingerprints ficam no índice; os mais antigos saem primeiro.
+const ackIndexMaxEntries = 100000
+
+// ackIndexMaxAge descarta fingerprints antigos: registros desse período não voltam a ser lidos
+// fora de um backfill, e aí a verificação remota ainda responde.
+const ackIndexMaxAge = 60 * 24 * time.Hour
+
+// ackIndex guarda os fingerprints dos jobs que a API já confirmou (enviados ou já existentes),
+// para que tryProcessImpression não precise chamar /central/verifyimpression de novo. O arquivo
+// é um log só de acréscimo ("<unix> <fingerprint>" por linha), compactado quando passa do dobro
+// do limite.
+type ackIndex struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]int64 // fingerprint -> momento da confirmação (unix)
+	order   []string         // Ordem de inserção, para descartar os mais antigos
+	lines   int              // Linhas no arquivo, incluindo as já descartadas da memória
+}
+
+var acked *ackIndex
+
+// setupAckIndex carrega o índice de jobs confirmados ao lado do arquivo de checkpoints.
+func setupAckIndex() error {
+	path := filepath.Join(os.Getenv("PROGRAMDATA"), "PrintWatchServiceLogs", "acked.idx")
+	index, err := loadAckIndex(path)
+	if err != nil {
+		return err
+	}
+	acked = index
+	globalLogger.Println(fmt.Sprintf("Acknowledged job index loaded from '%s' with %d entr(ies).", path, len(index.entries)))
+	return nil
+}
+
+// loadAckIndex lê o arquivo do índice (se existir) e o abre para acréscimos. Linhas
+// malformadas (ex: gravação interrompida) são ignoradas.
+func loadAckIndex(path string) (*ackIndex, error) {
+	index := &ackIndex{path: path, entries: make(map[string]int64)}
+
+	if file, err := os.Open(path); err == nil {
+		cutoff := time.Now().Add(-ackIndexMaxAge).Unix()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			index.lines++
+			at, fingerprint, ok := strings.Cut(scanner.Text(), " ")
+			unix, err := strconv.ParseInt(at, 10, 64)
+			if !ok || err != nil || len(fingerprint) != 32 || unix < cutoff {
+				continue
+			}
+			index.insert(fingerprint, unix)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read acknowledged job index '%s': %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open acknowledged job index '%s': %w", path, err)
+	}
+
+	if index.lines > 2*len(index.entries) && index.lines > ackIndexMaxEntries {
+		if err := index.compact(); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open acknowledged job index '%s': %w", path, err)
+	}
+	index.file = file
+	return index, nil
+}
+
+// jobFingerprint identifica um job no índice. Com JobID, a chave é o próprio JobID: dois jobs
+// idênticos no mesmo segundo têm JobIDs diferentes e não podem se confundir. Registros sem JobID
+// (pendências de versões anteriores) usam os campos que os distinguem: horário, usuário,
+// impressora, documento, páginas e máquina de origem.
+func jobFingerprint(data PrintData) string {
+	if data.JobID != "" {
+		sum := sha256.Sum256([]byte("jobid\x00" + data.JobID))
+		return hex.EncodeToString(sum[:16])
+	}
+	when := data.Timestamp
+	if when == "" {
+		when = data.Data + " " + data.Hora
+	}
+	key := strings.Join([]string{when, data.Usuario, data.Impressora, data.NomeArquivo, strconv.Itoa(data.Paginas), data.NomePC}, "\x00")
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Contains informa se o job já foi confirmado pela API. Sem índice carregado (ex: comandos de
+// linha), sempre responde false e a verificação remota é usada.
+func (x *ackIndex) Contains(data PrintData) bool {
+	if x == nil {
+		return false
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, found := x.entries[jobFingerprint(data)]
+	return found
+}
+
+// Add registra um job confirmado pela API. A linha é gravada com fsync antes de o job entrar no
+// índice em memória, para que os checkpoints possam contar com ela depois de uma queda. Uma
+// falha de gravação só é logada e deixa o job fora do índice: ele já foi entregue, e no pior
+// caso a próxima leitura dele volta a consultar a API.
+func (x *ackIndex) Add(data PrintData) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	fingerprint := jobFingerprint(data)
+	if _, found := x.entries[fingerprint]; found {
+		return
+	}
+	now := time.Now().Unix()
+	if _, err := fmt.Fprintf(x.file, "%d %s\n", now, fingerprint); err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Failed to append to acknowledged job index '%s': %v", x.path, err))
+		return
+	}
+	x.lines++
+	if err := x.file.Sync(); err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Failed to sync acknowledged job index '%s': %v", x.path, err))
+		return
+	}
+	x.insert(fingerprint, now)
+	if x.lines > 2*ackIndexMaxEntries {
+		if err := x.compact(); err != nil {
+			globalLogger.Println(fmt.Sprintf("WARNING: Failed to compact acknowledged job index: %v", err))
+		}
+	}
+}
+
+// insert adiciona o fingerprint em memória, descartando o mais antigo acima do limite. Deve ser
+// chamado com o mutex travado.
+func (x *ackIndex) insert(fingerprint string, at int64) {
+	if _, found := x.entries[fingerprint]; !found {
+		x.order = append(x.order, fingerprint)
+	}
+	x.entries[fingerprint] = at
+	for len(x.order) > ackIndexMaxEntries {
+		delete(x.entries, x.order[0])
+		x.order = x.order[1:]
+	}
+}
+
+// compact regrava o arquivo só com as entradas em memória. Deve ser chamado com o mutex
+// travado. O arquivo de acréscimos é fechado antes da troca (o Windows não renomeia sobre um
+// arquivo aberto) e reaberto mesmo se a regravação falhar, para que Add continue gravando.
+func (x *ackIndex) compact() error {
+	var b strings.Builder
+	for _, fingerprint := range x.order {
+		fmt.Fprintf(&b, "%d %s\n", x.entries[fingerprint], fingerprint)
+	}
+	reopen := x.file != nil
+	if reopen {
+		x.file.Close()
+		x.file = nil
+	}
+	err := writeFileAtomic(x.path, []byte(b.String()), 0644)
+	if err == nil {
+		x.lines = len(x.order)
+		x.order = append([]string(nil), x.order...) // Libera o início já descartado do slice
+	}
+	if !reopen {
+		return err
+	}
+	file, openErr := os.OpenFile(x.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if openErr != nil {
+		return fmt.Errorf("failed to reopen acknowledged job index '%s': %w", x.path, openErr)
+	}
+	x.file = file
+	return err
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Valores padrão de HTTPConfig.
+const (
+	defaultConnectTimeout        = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultRequestTimeout        = 60 * time.Second
+	defaultMaxIdleConnsPerHost   = 4
+	defaultIdleConnTimeout       = 90 * time.Second
+)
+
+// gzipMinSize é o menor corpo comprimido com http.gzip; abaixo disso o ganho não compensa.
+const gzipMinSize = 1024
+
+// apiClient faz todas as chamadas à API e ao endpoint de token, com a configuração de
+// Config.HTTP e Config.TLS. O transporte mantém as conexões abertas entre as chamadas. Antes de
+// setupAPIClient (ex: comandos de linha), é o cliente padrão do Go.
+var apiClient = http.DefaultClient
+
+// tokenClient faz as chamadas ao endpoint de token do OAuth2. É o próprio apiClient, exceto
+// quando há SPKI fixados e o tokenUrl está em outro servidor: os pins são da API, e o servidor
+// de token é validado só pelas CAs.
+var tokenClient = http.DefaultClient
+
+// apiGzip informa se os corpos devem ser comprimidos. É desligado se a API responder 415.
+var apiGzip atomic.Bool
+
+// errPinMismatch indica que nenhum certificado da cadeia do servidor tem um SPKI fixado.
+var errPinMismatch = errors.New("server certificate does not match any pinned SPKI")
+
+// setupAPIClient monta o cliente HTTP compartilhado pelas chamadas à API. Uma configuração
+// inválida impede o serviço de iniciar, em vez de cair silenciosamente para conexões sem a
+// proteção ou o proxy pedidos.
+func setupAPIClient(cfg *Config) error {
+	hc := &cfg.HTTP
+	tlsConfig, err := newAPITLSConfig(&cfg.TLS)
+	if err != nil {
+		return err
+	}
+	proxy, err := newProxyFunc(hc)
+	if err != nil {
+		return err
+	}
+
+	connectTimeout := secondsOr(hc.ConnectTimeout, defaultConnectTimeout)
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: secondsOr(hc.ResponseHeaderTimeout, defaultResponseHeaderTimeout),
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       secondsOr(hc.IdleConnTimeout, defaultIdleConnTimeout),
+	}
+	if hc.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = hc.MaxIdleConnsPerHost
+	}
+	apiClient = &http.Client{Transport: transport, Timeout: secondsOr(hc.Timeout, defaultRequestTimeout)}
+	apiGzip.Store(hc.Gzip)
+
+	tokenClient = apiClient
+	if tlsConfig.VerifyConnection != nil && cfg.Auth.TokenURL != "" && !isAPIHost(cfg, cfg.Auth.TokenURL) {
+		tokenTransport := transport.Clone()
+		tokenTransport.TLSClientConfig.VerifyConnection = nil
+		tokenClient = &http.Client{Transport: tokenTransport, Timeout: apiClient.Timeout}
+		globalLogger.Println(fmt.Sprintf("API TLS: pinned SPKIs do not apply to the token endpoint %s.", cfg.Auth.TokenURL))
+	}
+
+	globalLogger.Println(fmt.Sprintf("API HTTP client: connect timeout %s, response header timeout %s, total timeout %s, %d idle connection(s) per host, gzip %t.",
+		connectTimeout, transport.ResponseHeaderTimeout, apiClient.Timeout, transport.MaxIdleConnsPerHost, hc.Gzip))
+	return nil
+}
+
+// isAPIHost informa se rawURL aponta para o mesmo servidor (host e porta) de alguma URL base
+// da API.
+func isAPIHost(cfg *Config, rawURL string) bool {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	for _, baseURL := range cfg.ApiBaseURLs {
+		if u, err := url.Parse(baseURL); err == nil && hostPort(u) == hostPort(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPort retorna "host:porta" da URL, com a porta padrão do esquema quando omitida.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[strings.ToLower(u.Scheme)]
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// secondsOr converte um campo em segundos do config.json, usando def quando não informado.
+func secondsOr(seconds int, def time.Duration) time.Duration {
+	if seconds <= 0 {
+		return def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// closeResponse descarta o restante do corpo antes de fechá-lo, para que a conexão volte ao
+// pool e seja reaproveitada pela próxima chamada.
+func closeResponse(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+// gzipBody comprime o corpo de uma requisição.
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newProxyFunc escolhe o proxy de cada requisição. Sem proxy no config.json, usa as variáveis
+// de ambiente, como o cliente padrão do Go.
+func newProxyFunc(hc *HTTPConfig) (func(*http.Request) (*url.URL, error), error) {
+	if hc.HTTPProxy == "" && hc.HTTPSProxy == "" {
+		if hc.NoProxy != "" {
+			return nil, fmt.Errorf("http: noProxy requires httpProxy or httpsProxy")
+		}
+		return http.ProxyFromEnvironment, nil
+	}
+	httpProxy, err := parseProxyURL(hc.HTTPProxy)
+	if err != nil {
+		return nil, err
+	}
+	httpsProxy, err := parseProxyURL(hc.HTTPSProxy)
+	if err != nil {
+		return nil, err
+	}
+	bypass := parseNoProxy(hc.NoProxy)
+	globalLogger.Println(fmt.Sprintf("API proxy: http '%s', https '%s', no proxy '%s'.", redactProxy(httpProxy), redactProxy(httpsProxy), hc.NoProxy))
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxy := httpProxy
+		if req.URL.Scheme == "https" {
+			proxy = httpsProxy
+		}
+		if proxy == nil || bypass.matches(req.URL) {
+			return nil, nil
+		}
+		return proxy, nil
+	}, nil
+}
+
+// parseProxyURL aceita "http://host:porta" ou só "host:porta"; vazio é sem proxy.
+func parseProxyURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("http: invalid proxy URL '%s'", raw)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("http: unsupported proxy scheme '%s'", u.Scheme)
+	}
+	return u, nil
+}
+
+// redactProxy esconde a senha de um proxy autenticado no log.
+func redactProxy(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// noProxyList são os destinos acessados sem proxy, no formato da variável NO_PROXY: "*",
+// nomes ("exemplo.com" inclui os subdomínios, ".exemplo.com" só os subdomínios), IPs e
+// faixas CIDR, com porta opcional. localhost e endereços de loopback nunca usam proxy.
+type noProxyList struct {
+	all     bool
+	domains []noProxyEntry
+	ips     []noProxyEntry
+	nets    []*net.IPNet
+}
+
+type noProxyEntry struct {
+	host    string
+	port    string
+	subOnly bool
+}
+
+func parseNoProxy(list string) *noProxyList {
+	bypass := &noProxyList{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		switch {
+		case item == "":
+			continue
+		case item == "*":
+			bypass.all = true
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(item); err == nil {
+			bypass.nets = append(bypass.nets, ipNet)
+			continue
+		}
+		host, port, err := net.SplitHostPort(item)
+		if err != nil {
+			host, port = item, ""
+		}
+		host = strings.Trim(host, "[]")
+		if ip := net.ParseIP(host); ip != nil {
+			bypass.ips = append(bypass.ips, noProxyEntry{host: ip.String(), port: port})
+			continue
+		}
+		entry := noProxyEntry{host: strings.TrimPrefix(strings.TrimPrefix(host, "*"), "."), port: port}
+		entry.subOnly = strings.HasPrefix(host, ".") || strings.HasPrefix(host, "*.")
+		bypass.domains = append(bypass.domains, entry)
+	}
+	return bypass
+}
+
+// matches informa se a URL deve ser acessada sem proxy.
+func (b *noProxyList) matches(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if b.all || host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, ipNet := range b.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		for _, entry := range b.ips {
+			if entry.host == ip.String() && (entry.port == "" || entry.port == port) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, entry := range b.domains {
+		if entry.port != "" && entry.port != port {
+			continue
+		}
+		if strings.HasSuffix(host, "."+entry.host) || (!entry.subOnly && host == entry.host) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPITLSConfig monta a configuração TLS: CAs adicionais, certificado de cliente (mTLS),
+// versão mínima e SPKI fixados.
+func newAPITLSConfig(tc *TLSConfig) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(tc.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{MinVersion: minVersion}
+	var features []string
+
+	if tc.CAFile != "" {
+		// As CAs do arquivo somam-se às raízes do Windows, para que um tokenUrl público continue
+		// funcionando; para aceitar só a CA interna, use pinnedSpki
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: failed to read caFile '%s': %w", tc.CAFile, err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no PEM certificates found in caFile '%s'", tc.CAFile)
+		}
+		config.RootCAs = roots
+		features = append(features, "CA bundle "+tc.CAFile)
+	}
+
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			return nil, fmt.Errorf("tls: certFile and keyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: failed to load client certificate '%s': %w", tc.CertFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+		features = append(features, "client certificate "+tc.CertFile)
+	}
+
+	if len(tc.PinnedSPKI) > 0 {
+		pins := make(map[[sha256.Size]byte]bool, len(tc.PinnedSPKI))
+		for _, pin := range tc.PinnedSPKI {
+			sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("tls: invalid pinnedSpki '%s' (expected base64 of a SHA-256 hash)", pin)
+			}
+			pins[[sha256.Size]byte(sum)] = true
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs, pins)
+		}
+		features = append(features, fmt.Sprintf("%d pinned SPKI(s)", len(pins)))
+	}
+
+	features = append(features, "minimum "+tls.VersionName(minVersion))
+	globalLogger.Println("API TLS: " + strings.Join(features, ", "))
+	return config, nil
+}
+
+// verifySPKIPins aceita a conexão se algum certificado de uma cadeia já validada (folha,
+// intermediária ou raiz) tiver a chave pública fixada. Fixar a CA interna permite trocar o
+// certificado do servidor sem atualizar os agentes.
+func verifySPKIPins(cs tls.ConnectionState, pins map[[sha256.Size]byte]bool) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+				return nil
+			}
+		}
+	}
+	if len(cs.PeerCertificates) > 0 {
+		sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		return fmt.Errorf("%w (server presented sha256/%s)", errPinMismatch, base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return errPinMismatch
+}
+
+// parseTLSVersion converte "1.0" a "1.3" na constante do crypto/tls; vazio é TLS 1.2.
+func parseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "tls") {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	}
+	return 0, fmt.Errorf("tls: unsupported minVersion '%s' (use 1.0, 1.1, 1.2 or 1.3)", version)
+}
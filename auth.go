@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cabeçalhos da assinatura HMAC. A assinatura cobre "MÉTODO\nCAMINHO\nTIMESTAMP\nNONCE\n" seguido
+// do SHA-256 (hex) do corpo, para que a API possa recusar requisições alteradas, repetidas
+// (nonce já visto) ou fora da janela de tempo.
+const (
+	hmacHeaderKeyID     = "X-PrintWatch-Key-Id"
+	hmacHeaderTimestamp = "X-PrintWatch-Timestamp"
+	hmacHeaderNonce     = "X-PrintWatch-Nonce"
+	hmacHeaderSignature = "X-PrintWatch-Signature"
+)
+
+// defaultAPIKeyHeader é o cabeçalho da chave de API quando apiKeyHeader não é informado.
+const defaultAPIKeyHeader = "X-API-Key"
+
+// tokenRefreshMargin renova o token OAuth2 um pouco antes da expiração informada pelo servidor,
+// para que uma requisição não chegue à API com o token vencido.
+const tokenRefreshMargin = time.Minute
+
+// apiAuthenticator aplica as credenciais de AuthConfig às requisições para a API. Um
+// autenticador nil (sem credenciais configuradas) não altera as requisições.
+type apiAuthenticator struct {
+	cfg AuthConfig
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+	refresh   *tokenRefresh // Renovação em andamento, aguardada pelas demais requisições
+}
+
+// tokenRefresh é uma busca de token no endpoint; done é fechado quando ela termina.
+type tokenRefresh struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// apiAuth é compartilhado por todas as chamadas à API, como apiBreaker.
+var apiAuth *apiAuthenticator
+
+// validateAuthConfig confere se os métodos de autenticação configurados estão completos.
+func validateAuthConfig(auth *AuthConfig) error {
+	oauth := auth.TokenURL != "" || auth.ClientID != "" || auth.ClientSecret != ""
+	if oauth && (auth.TokenURL == "" || auth.ClientID == "" || auth.ClientSecret == "") {
+		return fmt.Errorf("auth: tokenUrl, clientId and clientSecret must be set together")
+	}
+	if auth.TokenURL != "" {
+		if u, err := url.Parse(auth.TokenURL); err != nil || u.Host == "" {
+			return fmt.Errorf("auth: invalid tokenUrl '%s'", auth.TokenURL)
+		}
+	}
+	if auth.HMACKeyID != "" && auth.HMACSecret == "" {
+		return fmt.Errorf("auth: hmacKeyId requires hmacSecret")
+	}
+	if auth.APIKeyHeader != "" && auth.APIKey == "" {
+		return fmt.Errorf("auth: apiKeyHeader requires apiKey")
+	}
+	return nil
+}
+
+// setupAPIAuth cria o autenticador global a partir da configuração.
+func setupAPIAuth(cfg *Config) {
+	auth := cfg.Auth
+	var methods []string
+	if auth.APIKey != "" {
+		if auth.APIKeyHeader == "" {
+			auth.APIKeyHeader = defaultAPIKeyHeader
+		}
+		methods = append(methods, "API key ("+auth.APIKeyHeader+")")
+	}
+	if auth.TokenURL != "" {
+		methods = append(methods, "OAuth2 client credentials ("+auth.TokenURL+")")
+	}
+	if auth.HMACSecret != "" {
+		methods = append(methods, "HMAC-SHA256 signing")
+	}
+	if len(methods) == 0 {
+		apiAuth = nil
+		globalLogger.Println("WARNING: No API authentication configured. Requests are sent without credentials.")
+		return
+	}
+	apiAuth = &apiAuthenticator{cfg: auth}
+	globalLogger.Println("API authentication: " + strings.Join(methods, ", "))
+}
+
+// Authorize adiciona as credenciais à requisição. body deve ser exatamente o corpo enviado,
+// pois é ele que a assinatura HMAC cobre.
+func (a *apiAuthenticator) Authorize(req *http.Request, body []byte) error {
+	if a == nil {
+		return nil
+	}
+	if a.cfg.APIKey != "" {
+		req.Header.Set(a.cfg.APIKeyHeader, a.cfg.APIKey)
+	}
+	if a.cfg.TokenURL != "" {
+		token, err := a.bearerToken()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if a.cfg.HMACSecret != "" {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return fmt.Errorf("failed to generate request nonce: %w", err)
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		nonceHex := hex.EncodeToString(nonce)
+		if a.cfg.HMACKeyID != "" {
+			req.Header.Set(hmacHeaderKeyID, a.cfg.HMACKeyID)
+		}
+		req.Header.Set(hmacHeaderTimestamp, timestamp)
+		req.Header.Set(hmacHeaderNonce, nonceHex)
+		req.Header.Set(hmacHeaderSignature, "v1="+signRequest(a.cfg.HMACSecret, req.Method, req.URL.EscapedPath(), timestamp, nonceHex, body))
+	}
+	return nil
+}
+
+// Rejected deve ser chamado quando a API responde 401: o token atual é descartado e a próxima
+// requisição obtém outro (ele pode ter sido revogado antes de expirar).
+func (a *apiAuthenticator) Rejected() {
+	if a == nil || a.cfg.TokenURL == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" {
+		globalLogger.Println("API rejected the OAuth2 token (401). A new token will be requested.")
+	}
+	a.token = ""
+}
+
+// signRequest calcula a assinatura HMAC-SHA256 (hex) de uma requisição.
+func signRequest(secret, method, path, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, path, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bearerToken retorna o token em cache ou obtém um novo no endpoint de token. A busca roda fora
+// do mutex; as requisições que chegam durante ela esperam pelo mesmo resultado, para que só
+// uma chegue ao servidor de token.
+func (a *apiAuthenticator) bearerToken() (string, error) {
+	a.mu.Lock()
+	if a.token != "" && time.Now().Before(a.expiresAt) {
+		token := a.token
+		a.mu.Unlock()
+		return token, nil
+	}
+	if refresh := a.refresh; refresh != nil {
+		a.mu.Unlock()
+		<-refresh.done
+		return refresh.token, refresh.err
+	}
+	refresh := &tokenRefresh{done: make(chan struct{})}
+	a.refresh = refresh
+	a.mu.Unlock()
+
+	token, expiresAt, err := a.fetchToken()
+
+	a.mu.Lock()
+	if err == nil {
+		a.token = token
+		a.expiresAt = expiresAt
+	}
+	a.refresh = nil
+	a.mu.Unlock()
+	refresh.token, refresh.err = token, err
+	close(refresh.done)
+	return token, err
+}
+
+// fetchToken pede um token ao endpoint de token (client credentials) e retorna o token e até
+// quando ele deve ser usado.
+func (a *apiAuthenticator) fetchToken() (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if a.cfg.Scope != "" {
+		form.Set("scope", a.cfg.Scope)
+	}
+	req, err := http.NewRequest(http.MethodPost, a.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to build token request to %s: %w", a.cfg.TokenURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.cfg.ClientID), url.QueryEscape(a.cfg.ClientSecret))
+
+	resp, err := tokenClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to request OAuth2 token from %s: %w", a.cfg.TokenURL, err)
+	}
+	defer closeResponse(resp)
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	// Erros do servidor de token não são do registro: não viram apiStatusError, para que o
+	// registro volte para a fila em vez de ir para o dead-letter
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token endpoint %s returned status %d - %s", a.cfg.TokenURL, resp.StatusCode, strings.TrimSpace(string(bodyBytes)))
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(bodyBytes, &tokenResp); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to parse token response from %s: %w", a.cfg.TokenURL, err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token response from %s has no access_token", a.cfg.TokenURL)
+	}
+	if tokenResp.TokenType != "" && !strings.EqualFold(tokenResp.TokenType, "bearer") {
+		return "", time.Time{}, fmt.Errorf("token endpoint %s returned unsupported token type '%s'", a.cfg.TokenURL, tokenResp.TokenType)
+	}
+
+	// Sem expires_in, o token é renovado a cada hora (ou antes, se a API responder 401)
+	lifetime := time.Hour
+	if tokenResp.ExpiresIn > 0 {
+		lifetime = time.Duration(tokenResp.ExpiresIn) * time.Second
+	}
+	globalLogger.Println(fmt.Sprintf("Obtained OAuth2 token from %s (valid for %s).", a.cfg.TokenURL, lifetime))
+	return tokenResp.AccessToken, time.Now().Add(max(lifetime-tokenRefreshMargin, lifetime/2)), nil
+}
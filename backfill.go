@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runBackfill implementa o comando "backfill --from YYYY-MM-DD --to YYYY-MM-DD", que reenvia
+// o histórico dos arquivos diários das fontes configuradas (ou só da indicada em --source). Os
+// arquivos são lidos desde o início, sem tocar nos checkpoints do serviço; o JobID estável de
+// cada registro torna o reenvio idempotente.
+func runBackfill(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fromStr := flags.String("from", "", "primeiro dia a processar (YYYY-MM-DD)")
+	toStr := flags.String("to", "", "último dia a processar (YYYY-MM-DD), padrão: o mesmo de --from")
+	sourceName := flags.String("source", "", "processa apenas a fonte com este nome (padrão: todas)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *fromStr == "" {
+		return fmt.Errorf("usage: backfill --from YYYY-MM-DD [--to YYYY-MM-DD] [--source NAME]")
+	}
+	if *toStr == "" {
+		*toStr = *fromStr
+	}
+
+	from, err := time.ParseInLocation("2006-01-02", *fromStr, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid --from date '%s': %w", *fromStr, err)
+	}
+	to, err := time.ParseInLocation("2006-01-02", *toStr, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid --to date '%s': %w", *toStr, err)
+	}
+	if to.Before(from) {
+		return fmt.Errorf("--to (%s) is before --from (%s)", *toStr, *fromStr)
+	}
+
+	if err := setupFileLogging("PrintWatch"); err != nil {
+		return err
+	}
+	cfg, err := readConfig()
+	if err != nil {
+		return err
+	}
+	// Falhas de envio vão para a mesma fila de pendências usada pelo serviço
+	if err := setupPendingDir(); err != nil {
+		return err
+	}
+	// O índice de jobs confirmados não é carregado: o backfill existe justamente para reenviar o
+	// que a API já confirmou uma vez (base reconstruída, empresa nova). A verificação de
+	// duplicatas da API e o Idempotency-Key mantêm o reenvio idempotente.
+	if err := setupAPIClient(cfg); err != nil {
+		return err
+	}
+	setupAPIAuth(cfg)
+	setupAPIEndpoints(cfg)
+
+	matched := false
+	for i := range cfg.Sources {
+		sc := &cfg.Sources[i]
+		if *sourceName != "" && sc.Name != *sourceName {
+			continue
+		}
+		matched = true
+		source, err := newLogSource(sc)
+		if err != nil {
+			return fmt.Errorf("log source %d ('%s'): %w", i, sc.PapercutLogDir, err)
+		}
+		if err := backfillSource(cfg, source, from, to); err != nil {
+			return err
+		}
+	}
+	if !matched {
+		return fmt.Errorf("no log source named '%s' in config.json", *sourceName)
+	}
+	return nil
+}
+
+// backfillSource reenvia os arquivos diários de uma fonte entre from e to. Fontes sem arquivo
+// por dia (ex: CUPS, que grava tudo no mesmo page_log) têm o arquivo lido uma única vez e só os
+// registros com Data dentro do intervalo são enviados.
+func backfillSource(cfg *Config, source LogSource, from, to time.Time) error {
+	globalLogger.Println(fmt.Sprintf("BACKFILL: Processing %s logs from %s to %s in '%s'.", source.Name(), from.Format("2006-01-02"), to.Format("2006-01-02"), source.Dir()))
+	if _, daily := source.FileDay(source.DailyFile(from)); !daily {
+		logPath := source.DailyFile(from)
+		inRange := func(data PrintData) bool {
+			return data.Data >= from.Format("2006-01-02") && data.Data <= to.Format("2006-01-02")
+		}
+		if err := backfillLogFile(cfg, source, logPath, true, inRange); err != nil {
+			if os.IsNotExist(err) {
+				globalLogger.Println(fmt.Sprintf("BACKFILL: No %s log (%s). Nothing to do.", source.Name(), logPath))
+				return nil
+			}
+			return fmt.Errorf("backfill of %s (%s) failed: %w", logPath, source.Name(), err)
+		}
+		globalLogger.Println(fmt.Sprintf("BACKFILL: Finished %s log '%s'.", source.Name(), logPath))
+		return nil
+	}
+
+	today := startOfDay(time.Now())
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		logPath := source.DailyFile(day)
+		if err := backfillLogFile(cfg, source, logPath, day.Before(today), nil); err != nil {
+			if os.IsNotExist(err) {
+				globalLogger.Println(fmt.Sprintf("BACKFILL: No %s log for %s (%s). Skipping day.", source.Name(), day.Format("2006-01-02"), logPath))
+				continue
+			}
+			return fmt.Errorf("backfill of %s (%s) failed: %w", day.Format("2006-01-02"), source.Name(), err)
+		}
+		globalLogger.Println(fmt.Sprintf("BACKFILL: Finished %s log for %s.", source.Name(), day.Format("2006-01-02")))
+	}
+	return nil
+}
+
+// backfillLogFile lê um arquivo diário inteiro sem persistir offsets. Se keep não for nil, só
+// os registros aceitos por ele são enviados.
+func backfillLogFile(cfg *Config, src LogSource, logPath string, final bool, keep func(PrintData) bool) error {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	globalLogger.Println(fmt.Sprintf("BACKFILL: Reading '%s' from offset 0.", logPath))
+	emit := func(data PrintData) {
+		deliverImpression(cfg, data, logPath)
+	}
+	commit := func(offset int64) error {
+		return nil
+	}
+	if batchEnabled(cfg) {
+		batch := newImpressionBatch(cfg, logPath)
+		defer batch.flush()
+		emit = batch.add
+		commit = func(offset int64) error {
+			if batch.due() {
+				batch.flush()
+			}
+			return nil
+		}
+	}
+	if keep != nil {
+		send := emit
+		emit = func(data PrintData) {
+			if keep(data) {
+				send(data)
+			}
+		}
+	}
+	_, err = src.Read(file, 0, final, emit, commit)
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// batchDefaultMaxAge é a idade máxima de um lote quando batchMaxAgeSeconds não é informado.
+const batchDefaultMaxAge = 5 * time.Second
+
+// batchUnsupportedRetry é quanto tempo o agente deixa de tentar o endpoint de lote depois que a
+// API respondeu que não o conhece (ela pode ser atualizada sem reiniciar o agente).
+const batchUnsupportedRetry = time.Hour
+
+// batchUnsupportedUntil guarda (em unix) até quando os envios vão direto para o endpoint único.
+var batchUnsupportedUntil atomic.Int64
+
+// batchResult é o resultado de um registro na resposta do endpoint de lote, na mesma ordem do
+// envio. Status "created" e "duplicate" contam como entregue, "invalid" (recusado na validação)
+// vai para o dead-letter e qualquer outro volta para a fila.
+type batchResult struct {
+	JobID  string `json:"jobid"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// impressionBatch acumula os registros lidos de uma fonte até BatchSize registros ou
+// BatchMaxAge de idade e os entrega de uma vez.
+type impressionBatch struct {
+	cfg     *Config
+	source  string
+	items   []PrintData
+	started time.Time
+}
+
+func newImpressionBatch(cfg *Config, source string) *impressionBatch {
+	return &impressionBatch{cfg: cfg, source: source}
+}
+
+func (b *impressionBatch) add(data PrintData) {
+	if len(b.items) == 0 {
+		b.started = time.Now()
+	}
+	b.items = append(b.items, data)
+}
+
+func (b *impressionBatch) empty() bool {
+	return len(b.items) == 0
+}
+
+// due informa se o lote atingiu o tamanho ou a idade máxima.
+func (b *impressionBatch) due() bool {
+	return len(b.items) >= b.cfg.BatchSize || (len(b.items) > 0 && time.Since(b.started) >= batchMaxAge(b.cfg))
+}
+
+// flush entrega o lote; registros não aceitos vão para a fila de pendências ou o dead-letter.
+// Retorna true se todos os registros do lote estão no índice de jobs confirmados.
+func (b *impressionBatch) flush() bool {
+	if len(b.items) == 0 {
+		return true
+	}
+	acknowledged := deliverImpressions(b.cfg, b.items, b.source)
+	b.items = nil
+	return acknowledged
+}
+
+// batchEnabled informa se os envios devem ser agrupados em lotes.
+func batchEnabled(cfg *Config) bool {
+	return cfg.BatchSize > 1
+}
+
+func batchMaxAge(cfg *Config) time.Duration {
+	if cfg.BatchMaxAge <= 0 {
+		return batchDefaultMaxAge
+	}
+	return time.Duration(cfg.BatchMaxAge) * time.Second
+}
+
+// deliverImpressions envia um lote e trata cada registro não aceito como deliverImpression faz
+// para um registro só. Retorna true se todos ficaram no índice de jobs confirmados.
+func deliverImpressions(cfg *Config, items []PrintData, sourceFile string) bool {
+	results := sendImpressionBatch(cfg, items, sourceFile)
+	acknowledged := true
+	for i, data := range items {
+		if !settleImpression(data, results[i], sourceFile) {
+			acknowledged = false
+		}
+	}
+	return acknowledged
+}
+
+// sendImpressionBatch envia os registros para /central/receptprintreqbatch e classifica o
+// resultado de cada um. Registros já confirmados no índice local são pulados; registros sem
+// JobID (ou com legacyVerify) e lotes que a API não aceita seguem pelo envio único.
+func sendImpressionBatch(cfg *Config, items []PrintData, sourceFile string) []deliveryResult {
+	results := make([]deliveryResult, len(items))
+	var batch []PrintData
+	var positions []int
+	for i, data := range items {
+		switch {
+		case acked.Contains(data):
+			results[i] = deliveryResult{outcome: outcomeDuplicate}
+		case data.JobID == "" || cfg.LegacyVerify || time.Now().Unix() < batchUnsupportedUntil.Load():
+			results[i] = tryProcessImpression(cfg, data, sourceFile)
+		default:
+			batch = append(batch, data)
+			positions = append(positions, i)
+		}
+	}
+	if len(batch) == 0 {
+		return results
+	}
+
+	baseURL := apiEndpoints.Current()
+	batchURL := baseURL + "/central/receptprintreqbatch"
+	response, err := postImpressionBatch(batchURL, batch)
+	if err == errBatchUnsupported {
+		batchUnsupportedUntil.Store(time.Now().Add(batchUnsupportedRetry).Unix())
+		globalLogger.Println(fmt.Sprintf("WARNING: API does not support batch submission. Sending records one at a time for the next %s.", batchUnsupportedRetry))
+	}
+	if err == errBatchUnsupported || classifyFailure(err) == outcomePermanent {
+		// Uma recusa do lote inteiro não diz qual registro é inválido: cada um é enviado sozinho
+		// para ter o seu próprio resultado
+		for j, data := range batch {
+			results[positions[j]] = tryProcessImpression(cfg, data, sourceFile)
+		}
+		return results
+	}
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("API_COMM_FAIL (Batch) for %d record(s) from source '%s'. Error: %v", len(batch), sourceFile, err))
+		for _, i := range positions {
+			results[i] = deliveryResult{outcome: outcomeTransient, err: err}
+		}
+		return results
+	}
+
+	accepted := 0
+	for j, result := range response {
+		data := batch[j]
+		if result.JobID != "" && result.JobID != data.JobID {
+			// Resultado fora de ordem: a partir daqui não dá para confiar na correspondência
+			globalLogger.Println(fmt.Sprintf("WARNING: Batch result %d has jobid %s, expected %s. Requeuing the remaining records.", j, result.JobID, data.JobID))
+			break
+		}
+		switch strings.ToLower(result.Status) {
+		case "created":
+			results[positions[j]] = deliveryResult{outcome: outcomeSuccess}
+		case "duplicate":
+			results[positions[j]] = deliveryResult{outcome: outcomeDuplicate}
+		default:
+			globalLogger.Println(fmt.Sprintf("API rejected record %s for user %s from source '%s' (status '%s'): %s", data.JobID, data.Usuario, sourceFile, result.Status, result.Error))
+			outcome := outcomeTransient
+			if strings.EqualFold(result.Status, "invalid") {
+				outcome = outcomePermanent
+			}
+			results[positions[j]] = deliveryResult{outcome: outcome, err: fmt.Errorf("batch API %s returned status '%s' for record %s: %s", batchURL, result.Status, data.JobID, result.Error)}
+			continue
+		}
+		acked.Add(data)
+		accepted++
+	}
+	globalLogger.Println(fmt.Sprintf("Batch of %d record(s) from source '%s': %d accepted by %s.", len(batch), sourceFile, accepted, baseURL))
+	return results
+}
+
+// errBatchUnsupported indica que a API não tem o endpoint de lote.
+var errBatchUnsupported = errors.New("batch endpoint not supported")
+
+// postImpressionBatch envia o lote e retorna um resultado por registro.
+func postImpressionBatch(apiEndpoint string, batch []PrintData) ([]batchResult, error) {
+	jsonData, err := json.Marshal(batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal batch: %w", err)
+	}
+	globalLogger.Println(fmt.Sprintf("Sending batch of %d record(s) to API %s", len(batch), apiEndpoint))
+
+	resp, err := postToAPI(apiEndpoint, jsonData, "")
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(resp)
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, errBatchUnsupported
+	case http.StatusOK, http.StatusCreated, http.StatusMultiStatus:
+	default:
+		return nil, &apiStatusError{Endpoint: apiEndpoint, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(bodyBytes))}
+	}
+
+	var response struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.Unmarshal(bodyBytes, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse batch response from %s: %w", apiEndpoint, err)
+	}
+	if len(response.Results) != len(batch) {
+		return nil, fmt.Errorf("batch response from %s has %d result(s) for %d record(s)", apiEndpoint, len(response.Results), len(batch))
+	}
+	return response.Results, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Parâmetros do circuit breaker da API.
+const (
+	breakerFailureThreshold = 5                // Falhas seguidas que abrem o circuito
+	breakerBaseBackoff      = 10 * time.Second // Primeira espera com o circuito aberto
+	breakerMaxBackoff       = 10 * time.Minute // Teto da espera exponencial
+	breakerProbeTimeout     = 2 * time.Minute  // Sonda sem resultado após esse tempo é substituída
+)
+
+// Estados do circuit breaker.
+const (
+	breakerClosed   = "CLOSED"    // Chamadas liberadas
+	breakerOpen     = "OPEN"      // Chamadas recusadas até a próxima sonda
+	breakerHalfOpen = "HALF-OPEN" // Uma única chamada (sonda) em andamento
+)
+
+// errCircuitOpen é retornado sem chamar a API enquanto o circuito está aberto.
+var errCircuitOpen = errors.New("API circuit breaker is open")
+
+// circuitBreaker protege as chamadas à API: depois de breakerFailureThreshold falhas seguidas,
+// as chamadas são recusadas na hora (e os registros vão para a fila de pendências) até o fim de
+// uma espera exponencial com jitter. Então uma única chamada sonda a API: sucesso fecha o
+// circuito; falha o reabre com o dobro da espera.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+	probeAt   time.Time // Início da sonda; uma sonda perdida não trava o circuito
+}
+
+// apiBreaker é compartilhado por todas as chamadas à API (verificação, envio, lotes e contadores).
+var apiBreaker = &circuitBreaker{state: breakerClosed}
+
+// Allow informa se uma chamada pode ser feita agora. Com o circuito aberto e a espera vencida,
+// libera só a primeira chamada, que vira a sonda.
+func (b *circuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return fmt.Errorf("%w (next probe in %s)", errCircuitOpen, time.Until(b.openUntil).Round(time.Second))
+		}
+		b.state = breakerHalfOpen
+		b.probeAt = time.Now()
+		globalLogger.Println("API circuit breaker HALF-OPEN: probing the API with a single request.")
+		return nil
+	case breakerHalfOpen:
+		if time.Since(b.probeAt) < breakerProbeTimeout {
+			return fmt.Errorf("%w (probe in progress)", errCircuitOpen)
+		}
+		b.probeAt = time.Now()
+		globalLogger.Println("API circuit breaker HALF-OPEN: previous probe did not finish, probing again.")
+	}
+	return nil
+}
+
+// Record registra o resultado de uma chamada liberada por Allow.
+func (b *circuitBreaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.state != breakerClosed {
+			globalLogger.Println(fmt.Sprintf("API circuit breaker CLOSED: API is responding again after %d failure(s).", b.failures))
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		b.backoff = 0
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+		b.backoff = min(2*b.backoff, breakerMaxBackoff)
+	case b.state == breakerClosed && b.failures >= breakerFailureThreshold:
+		b.backoff = breakerBaseBackoff
+	default:
+		return
+	}
+	b.state = breakerOpen
+	wait := withJitter(b.backoff)
+	b.openUntil = time.Now().Add(wait)
+	globalLogger.Println(fmt.Sprintf("API circuit breaker OPEN after %d consecutive failure(s). Next probe in %s.", b.failures, wait.Round(time.Second)))
+}
+
+// Reset fecha o circuito sem esperar a próxima sonda, quando as chamadas passam para um
+// endpoint da API que as sondas de saúde mostraram estar no ar.
+func (b *circuitBreaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		globalLogger.Println("API circuit breaker CLOSED: switched to a healthy API endpoint.")
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.backoff = 0
+}
+
+// IsOpen informa se as chamadas estão sendo recusadas (aberto, ou sonda em andamento).
+func (b *circuitBreaker) IsOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerHalfOpen || (b.state == breakerOpen && time.Now().Before(b.openUntil))
+}
+
+// retryBackoff é a espera antes da próxima tentativa de um registro da fila de pendências que
+// já falhou attempts vezes: a mesma espera exponencial do circuito, de breakerBaseBackoff até
+// breakerMaxBackoff, com jitter. Assim um registro que sempre falha não chama a API a cada ciclo.
+func retryBackoff(attempts int) time.Duration {
+	backoff := breakerBaseBackoff
+	for i := 1; i < attempts && backoff < breakerMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return withJitter(min(backoff, breakerMaxBackoff))
+}
+
+// withJitter sorteia uma espera entre metade e o total de d, para que vários agentes que
+// perderam a API ao mesmo tempo não voltem todos no mesmo instante.
+func withJitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// apiCallFailed informa se o resultado de uma chamada indica API indisponível: erro de rede,
+// 5xx ou 429. Outras respostas 4xx são problemas do registro, não da API.
+func apiCallFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+}
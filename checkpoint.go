@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fingerprintMaxBytes limita quantos bytes da primeira linha entram no fingerprint.
+const fingerprintMaxBytes = 4096
+
+// checkpointMaxAge é por quanto tempo o checkpoint de um arquivo que não é mais lido fica no
+// store: o mesmo horizonte do índice de jobs confirmados, além do qual um arquivo relido não
+// seria reconhecido como já enviado de qualquer forma.
+const checkpointMaxAge = ackIndexMaxAge
+
+// checkpointFlushRecords e checkpointFlushInterval limitam quantas atualizações de Update ficam
+// só em memória: o store é gravado a cada checkpointFlushRecords registros ou depois de
+// checkpointFlushInterval, o que vier primeiro.
+const (
+	checkpointFlushRecords  = 100
+	checkpointFlushInterval = 5 * time.Second
+)
+
+// FileCheckpoint registra até onde um arquivo de log já foi lido.
+type FileCheckpoint struct {
+	Path        string    `json:"path"`
+	Offset      int64     `json:"offset"`
+	Size        int64     `json:"size"`
+	Fingerprint string    `json:"fingerprint"`     // SHA-256 da primeira linha do arquivo
+	Final       bool      `json:"final,omitempty"` // Já lido como arquivo final (ver finalizeFileCheckpoint)
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// checkpointStore mantém os checkpoints em memória e os persiste em disco: na hora, com Set, ou
+// em intervalos, com Update.
+type checkpointStore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]FileCheckpoint
+	unsaved int       // Atualizações de Update ainda não gravadas
+	savedAt time.Time // Última gravação em disco
+}
+
+// checkpoints substitui o antigo mapa lastReadOffsets, que vivia apenas em memória.
+var checkpoints *checkpointStore
+
+// setupCheckpointStore carrega o arquivo de checkpoints ao lado do diretório de pendências.
+func setupCheckpointStore() error {
+	logDir := filepath.Join(os.Getenv("PROGRAMDATA"), "PrintWatchServiceLogs")
+	store, err := loadCheckpointStore(filepath.Join(logDir, "checkpoints.json"))
+	if err != nil {
+		return err
+	}
+	checkpoints = store
+	globalLogger.Println(fmt.Sprintf("Checkpoint store loaded from '%s' with %d entr(ies).", store.path, len(store.entries)))
+	return nil
+}
+
+// loadCheckpointStore lê o arquivo de checkpoints; se ele não existir, começa vazio.
+func loadCheckpointStore(path string) (*checkpointStore, error) {
+	store := &checkpointStore{path: path, entries: make(map[string]FileCheckpoint)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("failed to read checkpoint file '%s': %w", path, err)
+	}
+
+	var list []FileCheckpoint
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint file '%s': %w", path, err)
+	}
+	for _, cp := range list {
+		store.entries[cp.Path] = cp
+	}
+	return store, nil
+}
+
+// Get retorna o checkpoint salvo para o arquivo, se houver.
+func (s *checkpointStore) Get(path string) (FileCheckpoint, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp, found := s.entries[path]
+	return cp, found
+}
+
+// Set atualiza o checkpoint do arquivo e grava o store inteiro em disco.
+func (s *checkpointStore) Set(cp FileCheckpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp.UpdatedAt = time.Now()
+	s.entries[cp.Path] = cp
+	return s.save()
+}
+
+// Update atualiza o checkpoint do arquivo em memória e só grava o store depois de
+// checkpointFlushRecords atualizações ou checkpointFlushInterval desde a última gravação. Uma
+// queda antes disso faz os últimos registros serem relidos, então Update só serve para offsets
+// cujos registros já estão gravados no índice de jobs confirmados (ackIndex.Add faz fsync), que
+// os descarta na releitura; os demais devem usar Set.
+func (s *checkpointStore) Update(cp FileCheckpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp.UpdatedAt = time.Now()
+	s.entries[cp.Path] = cp
+	s.unsaved++
+	if s.unsaved < checkpointFlushRecords && time.Since(s.savedAt) < checkpointFlushInterval {
+		return nil
+	}
+	return s.save()
+}
+
+// Flush grava as atualizações de Update ainda pendentes.
+func (s *checkpointStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unsaved == 0 {
+		return nil
+	}
+	return s.save()
+}
+
+// save descarta os checkpoints antigos e grava os demais de forma atômica. Deve ser chamado
+// com o mutex travado.
+func (s *checkpointStore) save() error {
+	s.prune(time.Now())
+	list := make([]FileCheckpoint, 0, len(s.entries))
+	for _, cp := range s.entries {
+		list = append(list, cp)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoints: %w", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0644); err != nil {
+		return err
+	}
+	s.unsaved = 0
+	s.savedAt = time.Now()
+	return nil
+}
+
+// prune remove os checkpoints não atualizados há mais de checkpointMaxAge. O mais recente de
+// cada diretório é mantido, pois é dele que a recuperação retroativa (catchUpStartDay) parte
+// depois de uma parada longa.
+func (s *checkpointStore) prune(now time.Time) {
+	newest := make(map[string]FileCheckpoint)
+	for _, cp := range s.entries {
+		dir := checkpointDirKey(cp.Path)
+		if last, ok := newest[dir]; !ok || cp.UpdatedAt.After(last.UpdatedAt) {
+			newest[dir] = cp
+		}
+	}
+	cutoff := now.Add(-checkpointMaxAge)
+	for path, cp := range s.entries {
+		if cp.UpdatedAt.Before(cutoff) && newest[checkpointDirKey(path)].Path != path {
+			delete(s.entries, path)
+		}
+	}
+}
+
+// checkpointDirKey normaliza o diretório de um arquivo (caminhos do Windows não diferenciam
+// maiúsculas de minúsculas).
+func checkpointDirKey(path string) string {
+	return strings.ToLower(filepath.Clean(filepath.Dir(path)))
+}
+
+// writeFileAtomic grava em um arquivo temporário, força o flush para o disco e só então
+// renomeia sobre o destino. Assim, uma queda de energia deixa o arquivo antigo ou o novo,
+// nunca um arquivo pela metade.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for '%s': %w", path, err)
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write temp file '%s': %w", tmpPath, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync temp file '%s': %w", tmpPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close temp file '%s': %w", tmpPath, err)
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to chmod temp file '%s': %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace '%s': %w", path, err)
+	}
+	return nil
+}
+
+// fileFingerprint calcula o SHA-256 da primeira linha completa do arquivo, sem alterar a
+// posição de leitura. Retorna "" se a primeira linha ainda não terminou de ser escrita.
+func fileFingerprint(file *os.File) (string, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, fingerprintMaxBytes))
+	line, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read first line of '%s': %w", file.Name(), err)
+	}
+	if !bytes.HasSuffix(line, []byte("\n")) && len(line) < fingerprintMaxBytes {
+		return "", nil
+	}
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// saveFileCheckpoint persiste o offset lido junto com o tamanho e o fingerprint atuais do arquivo.
+func saveFileCheckpoint(file *os.File, path string, offset int64) error {
+	cp, err := newFileCheckpoint(file, path, offset)
+	if err != nil {
+		return err
+	}
+	if err := checkpoints.Set(cp); err != nil {
+		return fmt.Errorf("failed to persist checkpoint for '%s': %w", path, err)
+	}
+	return nil
+}
+
+// finalizeFileCheckpoint é saveFileCheckpoint para um arquivo lido como final: o checkpoint
+// fica marcado como finalizado e a recuperação retroativa não volta mais a esse dia.
+func finalizeFileCheckpoint(file *os.File, path string, offset int64) error {
+	cp, err := newFileCheckpoint(file, path, offset)
+	if err != nil {
+		return err
+	}
+	cp.Final = true
+	if err := checkpoints.Set(cp); err != nil {
+		return fmt.Errorf("failed to persist checkpoint for '%s': %w", path, err)
+	}
+	return nil
+}
+
+// updateFileCheckpoint é saveFileCheckpoint com gravação adiada (checkpointStore.Update), para
+// o avanço registro a registro.
+func updateFileCheckpoint(file *os.File, path string, offset int64) error {
+	cp, err := newFileCheckpoint(file, path, offset)
+	if err != nil {
+		return err
+	}
+	if err := checkpoints.Update(cp); err != nil {
+		return fmt.Errorf("failed to persist checkpoint for '%s': %w", path, err)
+	}
+	return nil
+}
+
+// newFileCheckpoint monta o checkpoint de offset com o tamanho e o fingerprint atuais do arquivo.
+func newFileCheckpoint(file *os.File, path string, offset int64) (FileCheckpoint, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return FileCheckpoint{}, fmt.Errorf("failed to stat log file '%s': %w", path, err)
+	}
+	fingerprint, err := fileFingerprint(file)
+	if err != nil {
+		return FileCheckpoint{}, err
+	}
+	return FileCheckpoint{
+		Path:        path,
+		Offset:      offset,
+		Size:        info.Size(),
+		Fingerprint: fingerprint,
+	}, nil
+}
+
+// fileEndsWithNewline informa se o último byte do arquivo (até size) é '\n'.
+func fileEndsWithNewline(file *os.File, size int64) (bool, error) {
+	if size == 0 {
+		return false, nil
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, size-1); err != nil {
+		return false, err
+	}
+	return last[0] == '\n', nil
+}
+
+// catchUpStartDay retorna o dia a partir do qual a recuperação retroativa drena os arquivos
+// diários da fonte: o mais antigo com checkpoint ainda não finalizado (um dia lido antes de
+// poder ser tratado como final, como o de ontem logo após a meia-noite) ou, se todos estiverem
+// finalizados, o mais recente com checkpoint. Em uma instalação nova não há checkpoint e nada é
+// recuperado retroativamente.
+func catchUpStartDay(src LogSource) (time.Time, bool) {
+	checkpoints.mu.Lock()
+	defer checkpoints.mu.Unlock()
+
+	var last, oldestOpen time.Time
+	found, open := false, false
+	for path, cp := range checkpoints.entries {
+		if !strings.EqualFold(filepath.Clean(filepath.Dir(path)), filepath.Clean(src.Dir())) {
+			continue
+		}
+		day, ok := src.FileDay(path)
+		if !ok {
+			continue
+		}
+		if !found || day.After(last) {
+			last = day
+			found = true
+		}
+		if !cp.Final && (!open || day.Before(oldestOpen)) {
+			oldestOpen = day
+			open = true
+		}
+	}
+	if open {
+		return oldestOpen, true
+	}
+	return last, found
+}
+
+// detectFileReset compara o arquivo com o checkpoint salvo e descreve por que ele não pode ser
+// retomado do offset antigo: truncado (menor que o offset ou que o tamanho registrado) ou
+// substituído/rotacionado (primeira linha diferente). Retorna "" se o checkpoint continua válido.
+func detectFileReset(file *os.File, cp FileCheckpoint) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat log file '%s': %w", cp.Path, err)
+	}
+	if info.Size() < cp.Offset {
+		return fmt.Sprintf("truncated: size %d is smaller than stored offset %d", info.Size(), cp.Offset), nil
+	}
+	if info.Size() < cp.Size {
+		return fmt.Sprintf("truncated: size %d is smaller than previously seen size %d", info.Size(), cp.Size), nil
+	}
+
+	fingerprint, err := fileFingerprint(file)
+	if err != nil {
+		return "", err
+	}
+	// Um fingerprint vazio significa que a primeira linha ainda não estava completa; não há o que comparar.
+	if cp.Fingerprint != "" && fingerprint != "" && fingerprint != cp.Fingerprint {
+		return "replaced or rotated: first line fingerprint changed", nil
+	}
+	return "", nil
+}
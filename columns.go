@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// maxHeaderScanLines é quantas linhas do início do arquivo são examinadas em busca do
+// cabeçalho. O Print Logger costuma escrever uma linha de banner antes dele.
+const maxHeaderScanLines = 5
+
+// maxHeaderScanBytes limita quanto do início do arquivo é lido ao procurar o cabeçalho.
+const maxHeaderScanBytes = 64 * 1024
+
+// Campos lógicos que podem ser lidos dos CSVs do PaperCut.
+const (
+	colTime         = "time"
+	colUser         = "user"
+	colPages        = "pages"
+	colCopies       = "copies"
+	colPrinter      = "printer"
+	colDocumentName = "documentName"
+	colClient       = "client"
+	colPaperSize    = "paperSize"
+	colGrayscale    = "grayscale"
+	colSize         = "size"
+)
+
+// knownColumns são os campos lógicos aceitos como chave em Config.ColumnMap.
+var knownColumns = []string{colTime, colUser, colPages, colCopies, colPrinter, colDocumentName, colClient, colPaperSize, colGrayscale, colSize}
+
+// requiredColumns são os campos sem os quais um registro não pode virar PrintData.
+var requiredColumns = []string{colTime, colUser, colPages, colCopies, colPrinter, colDocumentName}
+
+// errHeaderIncomplete indica que o cabeçalho ainda está sendo escrito.
+var errHeaderIncomplete = errors.New("CSV header is still being written")
+
+// columnIndex guarda a posição de cada campo lógico no registro.
+type columnIndex map[string]int
+
+// isKnownColumn informa se field é um campo lógico válido.
+func isKnownColumn(field string) bool {
+	for _, known := range knownColumns {
+		if field == known {
+			return true
+		}
+	}
+	return false
+}
+
+// buildColumnIndex monta o mapa de colunas a partir do cabeçalho. defaults traz o nome padrão
+// de cada campo no formato da fonte e overrides (Config.ColumnMap) o substitui.
+func buildColumnIndex(header []string, defaults, overrides map[string]string) (columnIndex, error) {
+	names := make(map[string]string, len(defaults))
+	for field, name := range defaults {
+		names[field] = name
+	}
+	for field, name := range overrides {
+		if !isKnownColumn(field) {
+			return nil, fmt.Errorf("unknown field '%s' in columnMap", field)
+		}
+		names[field] = name
+	}
+
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		key := normalizeColumnName(name)
+		if _, dup := positions[key]; !dup {
+			positions[key] = i
+		}
+	}
+
+	cols := make(columnIndex, len(names))
+	for field, name := range names {
+		if pos, ok := positions[normalizeColumnName(name)]; ok {
+			cols[field] = pos
+		}
+	}
+
+	var missing []string
+	for _, field := range requiredColumns {
+		if _, ok := cols[field]; !ok {
+			missing = append(missing, fmt.Sprintf("%s (%q)", field, names[field]))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("missing required column(s): %s", strings.Join(missing, ", "))
+	}
+	return cols, nil
+}
+
+// normalizeColumnName ignora BOM, espaços e maiúsculas/minúsculas ao comparar nomes de colunas.
+func normalizeColumnName(name string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+}
+
+// get retorna o valor do campo no registro, ou "" se a coluna não existir nele.
+func (c columnIndex) get(record []string, field string) string {
+	pos, ok := c[field]
+	if !ok || pos >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[pos])
+}
+
+// hasRequired informa se o registro tem todas as colunas obrigatórias.
+func (c columnIndex) hasRequired(record []string) bool {
+	for _, field := range requiredColumns {
+		if c[field] >= len(record) {
+			return false
+		}
+	}
+	return true
+}
+
+// newLogCSVReader cria o leitor CSV com as opções usadas para os logs do PaperCut.
+func newLogCSVReader(r io.Reader, comma rune) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1 // Permite um número variável de campos por linha
+	return reader
+}
+
+// parseDelimiters interpreta Config.Delimiter. Vazio ou "auto" testa vírgula, ponto e vírgula
+// e tabulação no cabeçalho; "tab" (ou "\t") e qualquer caractere único fixam o separador.
+func parseDelimiters(value string) ([]rune, error) {
+	switch strings.ToLower(value) {
+	case "", "auto":
+		return []rune{',', ';', '\t'}, nil
+	case "tab", "\\t":
+		return []rune{'\t'}, nil
+	}
+	runes := []rune(value)
+	if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+		return nil, fmt.Errorf("invalid delimiter '%s' (expected a single character, 'tab' or 'auto')", value)
+	}
+	return runes, nil
+}
+
+// csvHeader é o resultado da leitura do cabeçalho de um arquivo.
+type csvHeader struct {
+	cols  columnIndex
+	comma rune
+	end   int64 // Offset, em bytes do arquivo, logo após a linha do cabeçalho
+}
+
+// readCSVHeader procura o cabeçalho nas primeiras linhas do arquivo (após o BOM), testando cada
+// delimitador candidato. Enquanto o arquivo não for final e estiver vazio ou terminar em uma
+// linha ainda sem '\n', retorna errHeaderIncomplete; linhas completas sem um cabeçalho válido
+// resultam no erro do arquivo.
+func readCSVHeader(file *os.File, fileSize int64, enc textEncoding, bomLen int64, final bool, delimiters []rune, defaults, overrides map[string]string) (csvHeader, error) {
+	end := fileSize
+	if end > bomLen+maxHeaderScanBytes {
+		end = bomLen + maxHeaderScanBytes
+	}
+
+	lastErr := errors.New("file is empty")
+	incomplete := false
+	for _, comma := range delimiters {
+		section, err := newDecodedSection(file, enc, bomLen, end, '\n')
+		if err != nil {
+			return csvHeader{}, err
+		}
+		reader := newLogCSVReader(section.reader, comma)
+
+		scanned := 0
+		for ; scanned < maxHeaderScanLines; scanned++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			pos := reader.InputOffset()
+			if pos >= section.size && !section.endsWithNewline && !(final && end == fileSize) {
+				incomplete = true
+				break
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			cols, err := buildColumnIndex(record, defaults, overrides)
+			if err == nil {
+				return csvHeader{cols: cols, comma: comma, end: section.rawOffset(pos)}, nil
+			}
+			lastErr = err
+		}
+		if scanned == 0 && !final {
+			incomplete = true // Nada foi escrito até agora
+		}
+	}
+
+	if incomplete {
+		return csvHeader{}, errHeaderIncomplete
+	}
+	return csvHeader{}, fmt.Errorf("no usable CSV header in the first %d line(s) of '%s' (encoding %s): %w", maxHeaderScanLines, file.Name(), enc, lastErr)
+}
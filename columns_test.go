@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const printLoggerHeader = "Time,User,Pages,Copies,Printer,Document Name,Client,Paper Size,Language,Height,Width,Duplex,Grayscale,Size\n"
+
+func TestReadCSVHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		final      bool
+		incomplete bool
+		wantErr    bool
+		wantEnd    int64
+	}{
+		{name: "header only", content: printLoggerHeader, wantEnd: int64(len(printLoggerHeader))},
+		{name: "banner before header", content: "PaperCut Print Logger - http://www.papercut.com/\n" + printLoggerHeader, wantEnd: int64(len("PaperCut Print Logger - http://www.papercut.com/\n" + printLoggerHeader))},
+		{name: "empty file", content: "", incomplete: true},
+		{name: "empty final file", content: "", final: true, wantErr: true},
+		{name: "header still being written", content: "Time,User,Pages,Cop", incomplete: true},
+		{name: "header without newline in final file", content: strings.TrimSuffix(printLoggerHeader, "\n"), final: true, wantEnd: int64(len(printLoggerHeader) - 1)},
+		{name: "short file with a bad header", content: "Foo,Bar\n1,2\n", wantErr: true},
+		{name: "bad header followed by a partial line", content: "Foo,Bar\n1,", incomplete: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log.csv")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			delimiters, _ := parseDelimiters("auto")
+			header, err := readCSVHeader(file, int64(len(tt.content)), encUTF8, 0, tt.final, delimiters, printLoggerSchema.columns, nil)
+			switch {
+			case tt.incomplete:
+				if err != errHeaderIncomplete {
+					t.Errorf("got %v, want errHeaderIncomplete", err)
+				}
+			case tt.wantErr:
+				if err == nil || err == errHeaderIncomplete {
+					t.Errorf("got %v, want a header error", err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case header.end != tt.wantEnd || header.comma != ',':
+				t.Errorf("got end %d comma %q, want end %d comma ','", header.end, header.comma, tt.wantEnd)
+			}
+		})
+	}
+}
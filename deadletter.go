@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// deadLetterDir guarda os registros que a API recusou de forma definitiva.
+var deadLetterDir string
+
+// deliveryOutcome classifica o resultado de uma tentativa de entrega.
+type deliveryOutcome int
+
+const (
+	outcomeTransient deliveryOutcome = iota // Falha de rede, 5xx ou circuito aberto: tentar de novo (valor zero)
+	outcomeSuccess                          // Registro aceito pela API
+	outcomeDuplicate                        // A API (ou o índice local) já tinha o registro
+	outcomePermanent                        // Recusado na validação (4xx): vai para o dead-letter
+)
+
+func (o deliveryOutcome) String() string {
+	switch o {
+	case outcomeSuccess:
+		return "success"
+	case outcomeDuplicate:
+		return "duplicate"
+	case outcomePermanent:
+		return "permanent"
+	default:
+		return "transient"
+	}
+}
+
+// deliveryResult é o resultado da entrega de um registro; err traz a última falha.
+type deliveryResult struct {
+	outcome deliveryOutcome
+	err     error
+}
+
+// delivered informa se o registro pode sair da fila.
+func (r deliveryResult) delivered() bool {
+	return r.outcome == outcomeSuccess || r.outcome == outcomeDuplicate
+}
+
+// failedDelivery monta o resultado de uma falha, classificada pelo erro.
+func failedDelivery(err error) deliveryResult {
+	return deliveryResult{outcome: classifyFailure(err), err: err}
+}
+
+// apiStatusError é retornado quando a API responde com um status de erro. O corpo da resposta
+// é guardado para o dead-letter, onde costuma explicar o que a validação recusou.
+type apiStatusError struct {
+	Endpoint   string
+	StatusCode int
+	Body       string
+}
+
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("API %s returned status %d - %s", e.Endpoint, e.StatusCode, e.Body)
+}
+
+// classifyFailure separa as falhas que uma nova tentativa pode resolver das que não vão mudar.
+// Só respostas 4xx de validação são permanentes; 401/403/404/407 apontam para configuração
+// (chave, URL, proxy) e não para o registro, e 408/409/425/429 são passageiras.
+func classifyFailure(err error) deliveryOutcome {
+	var statusErr *apiStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode < 400 || statusErr.StatusCode >= 500 {
+		return outcomeTransient
+	}
+	switch statusErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusProxyAuthRequired,
+		http.StatusRequestTimeout, http.StatusConflict, http.StatusTooEarly, http.StatusTooManyRequests:
+		return outcomeTransient
+	}
+	return outcomePermanent
+}
+
+// pendingImpression é o conteúdo de um arquivo da fila de pendências.
+type pendingImpression struct {
+	Impression   PrintData `json:"impression"`
+	Attempts     int       `json:"attempts"`
+	FirstFailure time.Time `json:"firstFailure"`
+	// NextAttempt é quando o registro pode ser reenviado (retryBackoff); zero: no próximo ciclo
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+}
+
+// deadLetterEntry é o conteúdo de um arquivo do dead-letter: o registro e o motivo da recusa.
+type deadLetterEntry struct {
+	Impression   PrintData `json:"impression"`
+	StatusCode   int       `json:"statusCode,omitempty"`
+	Response     string    `json:"response,omitempty"`
+	Error        string    `json:"error"`
+	Source       string    `json:"source"`
+	Attempts     int       `json:"attempts"`
+	FirstFailure time.Time `json:"firstFailure"`
+	DeadLetterAt time.Time `json:"deadLetteredAt"`
+}
+
+// queueFileName gera um nome único para arquivos da fila e do dead-letter. O contador evita
+// colisão de nomes entre fontes que enfileiram ao mesmo tempo.
+func queueFileName() string {
+	return fmt.Sprintf("%d-%d.json", time.Now().UnixNano(), pendingSeq.Add(1))
+}
+
+// readPendingImpression lê um arquivo da fila. Arquivos gravados por versões anteriores
+// contêm só o PrintData; para eles, a primeira falha é a data do arquivo.
+func readPendingImpression(path string) (pendingImpression, error) {
+	fileData, err := os.ReadFile(path)
+	if err != nil {
+		return pendingImpression{}, err
+	}
+	var entry pendingImpression
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(fileData, &envelope); err != nil {
+		return entry, err
+	}
+	if _, found := envelope["impression"]; found {
+		err = json.Unmarshal(fileData, &entry)
+		return entry, err
+	}
+
+	if err := json.Unmarshal(fileData, &entry.Impression); err != nil {
+		return pendingImpression{}, err
+	}
+	entry.Attempts = 1
+	if info, err := os.Stat(path); err == nil {
+		entry.FirstFailure = info.ModTime()
+	}
+	return entry, nil
+}
+
+// writePendingImpression grava (ou regrava) um arquivo da fila.
+func writePendingImpression(path string, entry pendingImpression) error {
+	jsonData, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending impression data: %w", err)
+	}
+	if err := writeFileAtomic(path, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write pending impression to file '%s': %w", path, err)
+	}
+	return nil
+}
+
+// saveDeadLetter grava o registro recusado no dead-letter com o status e o corpo da resposta.
+func saveDeadLetter(entry pendingImpression, failure error, sourceFile string) error {
+	letter := deadLetterEntry{
+		Impression:   entry.Impression,
+		Error:        failure.Error(),
+		Source:       sourceFile,
+		Attempts:     entry.Attempts,
+		FirstFailure: entry.FirstFailure,
+		DeadLetterAt: time.Now(),
+	}
+	var statusErr *apiStatusError
+	if errors.As(failure, &statusErr) {
+		letter.StatusCode = statusErr.StatusCode
+		letter.Response = statusErr.Body
+	}
+
+	jsonData, err := json.MarshalIndent(letter, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead-letter entry: %w", err)
+	}
+	filePath := filepath.Join(deadLetterDir, queueFileName())
+	if err := writeFileAtomic(filePath, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write dead-letter entry to file '%s': %w", filePath, err)
+	}
+	globalLogger.Println(fmt.Sprintf("DEAD_LETTER: Impression for user %s from source '%s' was rejected by the API after %d attempt(s) and moved to '%s'. Error: %v", entry.Impression.Usuario, sourceFile, entry.Attempts, filePath, failure))
+	return nil
+}
+
+// settleImpression trata o resultado da primeira tentativa de um registro: falhas transitórias
+// vão para a fila de pendências e permanentes para o dead-letter. Retorna true se o registro
+// está gravado no índice de jobs confirmados, ou seja, se relê-lo depois de uma queda não o
+// envia nem enfileira de novo.
+func settleImpression(data PrintData, result deliveryResult, sourceFile string) bool {
+	switch result.outcome {
+	case outcomeSuccess, outcomeDuplicate:
+		return acked.Contains(data)
+	case outcomePermanent:
+		entry := pendingImpression{Impression: data, Attempts: 1, FirstFailure: time.Now()}
+		err := saveDeadLetter(entry, result.err, sourceFile)
+		if err == nil {
+			return false
+		}
+		globalLogger.Println(fmt.Sprintf("ERROR: %v. Keeping the impression in the pending queue.", err))
+	}
+	// A falha já foi logada por quem tentou a entrega. Agora, apenas enfileiramos.
+	if err := savePendingImpression(data); err != nil {
+		// Este é um erro crítico, pois a fila não está funcionando.
+		globalLogger.Println(fmt.Sprintf("CRITICAL_ERROR: FAILED TO SAVE PENDING IMPRESSION for user %s. Data may be lost. Error: %v", data.Usuario, err))
+	}
+	return false
+}
+
+// settlePendingFile trata o resultado de uma nova tentativa de um arquivo da fila: entregue sai
+// da fila, permanente vai para o dead-letter e transitória fica com o contador atualizado.
+func settlePendingFile(filePath string, entry pendingImpression, result deliveryResult) {
+	switch result.outcome {
+	case outcomeSuccess, outcomeDuplicate:
+		globalLogger.Println(fmt.Sprintf("Successfully processed pending impression '%s' (%s). Removing from queue.", filePath, result.outcome))
+	case outcomePermanent:
+		entry.Attempts++
+		if err := saveDeadLetter(entry, result.err, filePath); err != nil {
+			globalLogger.Println(fmt.Sprintf("ERROR: %v. Keeping '%s' in the pending queue.", err, filePath))
+			return
+		}
+	default:
+		// Com o circuito aberto a API nem foi chamada, então não conta como tentativa
+		if errors.Is(result.err, errCircuitOpen) {
+			return
+		}
+		entry.Attempts++
+		wait := retryBackoff(entry.Attempts)
+		entry.NextAttempt = time.Now().Add(wait)
+		globalLogger.Println(fmt.Sprintf("Failed to process pending impression '%s' (attempt %d). Will retry in %s.", filePath, entry.Attempts, wait.Round(time.Second)))
+		if err := writePendingImpression(filePath, entry); err != nil {
+			globalLogger.Println(fmt.Sprintf("ERROR: Failed to update attempt count of '%s': %v", filePath, err))
+		}
+		return
+	}
+	if err := os.Remove(filePath); err != nil {
+		globalLogger.Println(fmt.Sprintf("ERROR: Failed to remove processed pending file '%s': %v", filePath, err))
+	}
+}
+
+// runDeadLetter implementa o comando "deadletter", para inspecionar e reenfileirar os
+// registros recusados:
+//
+//	deadletter list
+//	deadletter show ARQUIVO
+//	deadletter requeue ARQUIVO... | --all
+func runDeadLetter(args []string) error {
+	const usage = "usage: deadletter list | show FILE | requeue FILE... | requeue --all"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	if err := setupFileLogging("PrintWatch"); err != nil {
+		return err
+	}
+	if err := setupPendingDir(); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return listDeadLetters()
+	case "show":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		fileData, err := os.ReadFile(deadLetterPath(args[1]))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(fileData)
+		return err
+	case "requeue":
+		flags := flag.NewFlagSet("deadletter requeue", flag.ContinueOnError)
+		all := flags.Bool("all", false, "reenfileira todos os registros do dead-letter")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		names := flags.Args()
+		if *all == (len(names) > 0) {
+			return errors.New(usage)
+		}
+		if *all {
+			files, err := deadLetterFiles()
+			if err != nil {
+				return err
+			}
+			names = files
+		}
+		for _, name := range names {
+			if err := requeueDeadLetter(deadLetterPath(name)); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%d record(s) moved back to the pending queue.\n", len(names))
+		return nil
+	}
+	return errors.New(usage)
+}
+
+// deadLetterPath aceita o nome do arquivo (como mostrado por "list") ou um caminho.
+func deadLetterPath(name string) string {
+	if filepath.Base(name) == name {
+		return filepath.Join(deadLetterDir, name)
+	}
+	return name
+}
+
+// deadLetterFiles lista os arquivos do dead-letter em ordem de gravação.
+func deadLetterFiles() ([]string, error) {
+	files, err := os.ReadDir(deadLetterDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read dead-letter directory '%s': %w", deadLetterDir, err)
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+func readDeadLetter(path string) (deadLetterEntry, error) {
+	var letter deadLetterEntry
+	fileData, err := os.ReadFile(path)
+	if err != nil {
+		return letter, err
+	}
+	if err := json.Unmarshal(fileData, &letter); err != nil {
+		return letter, fmt.Errorf("failed to parse dead-letter file '%s': %w", path, err)
+	}
+	return letter, nil
+}
+
+// listDeadLetters mostra um resumo de cada registro do dead-letter.
+func listDeadLetters() error {
+	names, err := deadLetterFiles()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSTATUS\tATTEMPTS\tFIRST FAILURE\tUSER\tPRINTER\tRESPONSE")
+	for _, name := range names {
+		letter, err := readDeadLetter(filepath.Join(deadLetterDir, name))
+		if err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t%v\n", name, err)
+			continue
+		}
+		response := firstNonEmpty(letter.Response, letter.Error)
+		if len(response) > 80 {
+			response = response[:77] + "..."
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", name, letter.StatusCode, letter.Attempts,
+			letter.FirstFailure.Format("2006-01-02 15:04:05"), letter.Impression.Usuario, letter.Impression.Impressora,
+			strings.Join(strings.Fields(response), " "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d record(s) in '%s'.\n", len(names), deadLetterDir)
+	return nil
+}
+
+// requeueDeadLetter devolve um registro do dead-letter para a fila de pendências, mantendo as
+// tentativas e a data da primeira falha. O serviço o envia no próximo ciclo.
+func requeueDeadLetter(path string) error {
+	letter, err := readDeadLetter(path)
+	if err != nil {
+		return err
+	}
+	entry := pendingImpression{Impression: letter.Impression, Attempts: letter.Attempts, FirstFailure: letter.FirstFailure}
+	pendingPath := filepath.Join(pendingDir, queueFileName())
+	if err := writePendingImpression(pendingPath, entry); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		os.Remove(pendingPath) // Evita o registro em duplicidade nas duas filas
+		return fmt.Errorf("failed to remove dead-letter file '%s': %w", path, err)
+	}
+	globalLogger.Println(fmt.Sprintf("Requeued dead-letter '%s' as pending impression '%s'.", path, pendingPath))
+	return nil
+}
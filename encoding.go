@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// encodingSniffBytes é quanto do início do arquivo é examinado para detectar a codificação.
+const encodingSniffBytes = 4096
+
+// textEncoding é a codificação de caracteres de um arquivo de log.
+type textEncoding int
+
+const (
+	encUTF8 textEncoding = iota
+	encWindows1252
+	encUTF16LE
+	encUTF16BE
+)
+
+// encodingAuto detecta a codificação pelo BOM ou pelo conteúdo (padrão de Config.Encoding).
+const encodingAuto = "auto"
+
+func (e textEncoding) String() string {
+	switch e {
+	case encWindows1252:
+		return "windows-1252"
+	case encUTF16LE:
+		return "utf-16le"
+	case encUTF16BE:
+		return "utf-16be"
+	}
+	return "utf-8"
+}
+
+// parseEncodingName valida o valor de Config.Encoding. auto é true para "" ou "auto".
+func parseEncodingName(name string) (enc textEncoding, auto bool, err error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", encodingAuto:
+		return encUTF8, true, nil
+	case "utf-8", "utf8":
+		return encUTF8, false, nil
+	case "windows-1252", "cp1252", "latin1", "iso-8859-1", "ansi":
+		return encWindows1252, false, nil
+	case "utf-16", "utf-16le", "utf16le", "unicode":
+		return encUTF16LE, false, nil
+	case "utf-16be", "utf16be":
+		return encUTF16BE, false, nil
+	}
+	return encUTF8, false, fmt.Errorf("unsupported encoding '%s' (expected auto, utf-8, windows-1252, utf-16le or utf-16be)", name)
+}
+
+// detectEncoding descobre a codificação do arquivo e o tamanho do BOM. O BOM sempre prevalece;
+// sem ele, usa a codificação configurada ou, em modo auto, examina o início do arquivo.
+func detectEncoding(file *os.File, configured string) (textEncoding, int64, error) {
+	enc, auto, err := parseEncodingName(configured)
+	if err != nil {
+		return enc, 0, err
+	}
+
+	head := make([]byte, encodingSniffBytes)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return enc, 0, fmt.Errorf("failed to read start of '%s': %w", file.Name(), err)
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return encUTF8, 3, nil
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return encUTF16LE, 2, nil
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return encUTF16BE, 2, nil
+	}
+	if !auto {
+		return enc, 0, nil
+	}
+	return sniffEncoding(head), 0, nil
+}
+
+// sniffEncoding adivinha a codificação de um trecho sem BOM: bytes nulos indicam UTF-16,
+// UTF-8 válido fica como UTF-8 e o restante é tratado como Windows-1252.
+func sniffEncoding(head []byte) textEncoding {
+	var evenZeros, oddZeros int
+	for i, b := range head {
+		if b == 0 {
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+	}
+	if oddZeros > len(head)/4 {
+		return encUTF16LE
+	}
+	if evenZeros > len(head)/4 {
+		return encUTF16BE
+	}
+
+	// Descarta a última linha, que pode ter um caractere multibyte cortado pela leitura
+	if idx := bytes.LastIndexByte(head, '\n'); idx >= 0 {
+		head = head[:idx+1]
+	}
+	if utf8.Valid(head) {
+		return encUTF8
+	}
+	return encWindows1252
+}
+
+// decodedSection expõe um trecho [start, end) do arquivo já convertido para UTF-8, junto com a
+// conversão de offsets do texto convertido para bytes do arquivo original.
+type decodedSection struct {
+	reader          io.Reader
+	size            int64 // Tamanho do texto convertido
+	endsWithNewline bool  // O texto convertido termina em '\n'
+	rawOffset       func(decoded int64) int64
+}
+
+// offsetMark associa uma posição do texto convertido à posição no arquivo original.
+type offsetMark struct {
+	decoded int64
+	raw     int64
+}
+
+// newDecodedSection prepara a leitura de [start, end). Para UTF-8 o arquivo é lido direto;
+// nas demais codificações o trecho é convertido em memória, registrando o offset original
+// logo após cada boundary (o caractere que encerra um registro, '\n' nos CSVs) para que os
+// checkpoints continuem em bytes do arquivo.
+func newDecodedSection(file *os.File, enc textEncoding, start, end int64, boundary rune) (*decodedSection, error) {
+	if enc == encUTF8 {
+		endsWithNewline, err := fileEndsWithNewline(file, end)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect end of log file '%s': %w", file.Name(), err)
+		}
+		return &decodedSection{
+			reader:          io.NewSectionReader(file, start, end-start),
+			size:            end - start,
+			endsWithNewline: endsWithNewline && end > start,
+			rawOffset:       func(decoded int64) int64 { return start + decoded },
+		}, nil
+	}
+
+	raw := make([]byte, end-start)
+	if _, err := file.ReadAt(raw, start); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read log file '%s': %w", file.Name(), err)
+	}
+	decoded, marks, consumed := decodeWithOffsets(raw, enc, boundary)
+	for i := range marks {
+		marks[i].raw += start
+	}
+
+	return &decodedSection{
+		reader:          bytes.NewReader(decoded),
+		size:            int64(len(decoded)),
+		endsWithNewline: len(decoded) > 0 && decoded[len(decoded)-1] == '\n',
+		rawOffset: func(pos int64) int64 {
+			if pos >= int64(len(decoded)) {
+				return start + int64(consumed)
+			}
+			// Registros completos terminam logo após um boundary; se não for o caso, volta para
+			// a última marca conhecida, relendo o trecho no próximo ciclo.
+			i := sort.Search(len(marks), func(i int) bool { return marks[i].decoded > pos })
+			if i == 0 {
+				return start
+			}
+			return marks[i-1].raw
+		},
+	}, nil
+}
+
+// decodeWithOffsets converte raw para UTF-8. Retorna o texto, as marcas de offset após cada
+// boundary e quantos bytes de raw foram consumidos (um caractere cortado no fim fica de fora).
+func decodeWithOffsets(raw []byte, enc textEncoding, boundary rune) ([]byte, []offsetMark, int) {
+	out := make([]byte, 0, len(raw)+len(raw)/2)
+	var marks []offsetMark
+	i := 0
+	for i < len(raw) {
+		var r rune
+		n := 0
+		switch enc {
+		case encWindows1252:
+			r, n = windows1252Rune(raw[i]), 1
+		case encUTF16LE, encUTF16BE:
+			r, n = decodeUTF16Rune(raw[i:], enc == encUTF16BE)
+		}
+		if n == 0 {
+			break // Caractere incompleto no fim do trecho
+		}
+		i += n
+		out = utf8.AppendRune(out, r)
+		if r == boundary {
+			marks = append(marks, offsetMark{decoded: int64(len(out)), raw: int64(i)})
+		}
+	}
+	return out, marks, i
+}
+
+// decodeUTF16Rune decodifica um caractere UTF-16 do início de b. Retorna n == 0 se b não
+// contém o caractere inteiro.
+func decodeUTF16Rune(b []byte, bigEndian bool) (rune, int) {
+	unit := func(p []byte) uint16 {
+		if bigEndian {
+			return uint16(p[0])<<8 | uint16(p[1])
+		}
+		return uint16(p[1])<<8 | uint16(p[0])
+	}
+	if len(b) < 2 {
+		return 0, 0
+	}
+	u1 := unit(b)
+	if !utf16.IsSurrogate(rune(u1)) {
+		return rune(u1), 2
+	}
+	if len(b) < 4 {
+		return 0, 0
+	}
+	r := utf16.DecodeRune(rune(u1), rune(unit(b[2:])))
+	if r == utf8.RuneError {
+		return utf8.RuneError, 2
+	}
+	return r, 4
+}
+
+// windows1252High mapeia os bytes 0x80-0x9F do Windows-1252; os demais coincidem com o Latin-1.
+var windows1252High = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+func windows1252Rune(b byte) rune {
+	if b >= 0x80 && b <= 0x9F {
+		return windows1252High[b-0x80]
+	}
+	return rune(b)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parâmetros do failover entre as URLs base da API.
+const (
+	failoverThreshold   = 3                // Falhas seguidas no endpoint ativo antes de trocar
+	healthProbeInterval = 30 * time.Second // Intervalo entre as sondas de saúde
+	healthProbeTimeout  = 5 * time.Second  // Tempo limite de cada sonda
+	failbackProbes      = 2                // Sondas seguidas com sucesso para voltar a um endpoint preferido
+)
+
+// apiEndpoint é uma URL base da API com o resultado das últimas sondas.
+type apiEndpoint struct {
+	baseURL   string
+	healthy   bool // Última sonda respondeu (true até a primeira sonda)
+	successes int  // Sondas seguidas com sucesso
+}
+
+// endpointPool escolhe a URL base usada nas chamadas à API. As URLs ficam em ordem de
+// preferência: depois de failoverThreshold falhas seguidas (as mesmas que o circuit breaker
+// conta: rede, 5xx ou 429), o agente passa para a próxima URL que as sondas indicam estar no ar,
+// e volta para uma URL preferida quando ela responde a failbackProbes sondas seguidas.
+type endpointPool struct {
+	mu         sync.Mutex
+	endpoints  []*apiEndpoint
+	active     int
+	failures   int // Falhas seguidas no endpoint ativo
+	healthPath string
+}
+
+// apiEndpoints é compartilhado por todas as chamadas à API, como apiBreaker.
+var apiEndpoints = &endpointPool{}
+
+// setupAPIEndpoints monta o pool com as URLs de cfg.ApiBaseURLs, começando pela principal.
+func setupAPIEndpoints(cfg *Config) {
+	pool := &endpointPool{healthPath: cfg.ApiHealthPath}
+	for _, baseURL := range cfg.ApiBaseURLs {
+		pool.endpoints = append(pool.endpoints, &apiEndpoint{baseURL: baseURL, healthy: true})
+	}
+	apiEndpoints = pool
+	if len(pool.endpoints) > 1 {
+		globalLogger.Println(fmt.Sprintf("API endpoints (in order of preference): %s. Health probe: %s every %s.", strings.Join(cfg.ApiBaseURLs, ", "), pool.healthPath, healthProbeInterval))
+	}
+}
+
+// Current retorna a URL base que as chamadas devem usar agora.
+func (p *endpointPool) Current() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.endpoints) == 0 {
+		return ""
+	}
+	return p.endpoints[p.active].baseURL
+}
+
+// Record registra o resultado de uma chamada a apiEndpoint (URL completa). Resultados de outro
+// endpoint que não o ativo (chamadas feitas antes de uma troca) são ignorados.
+func (p *endpointPool) Record(apiEndpoint string, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.endpoints) < 2 || !strings.HasPrefix(apiEndpoint, p.endpoints[p.active].baseURL+"/") {
+		return
+	}
+	if !failed {
+		p.failures = 0
+		return
+	}
+	p.failures++
+	if p.failures < failoverThreshold {
+		return
+	}
+
+	// Próximo endpoint: o preferido entre os que as sondas indicam no ar; sem nenhum, o seguinte
+	// da lista
+	current := p.endpoints[p.active]
+	current.healthy = false
+	current.successes = 0
+	next := (p.active + 1) % len(p.endpoints)
+	for i, endpoint := range p.endpoints {
+		if i != p.active && endpoint.healthy {
+			next = i
+			break
+		}
+	}
+	globalLogger.Println(fmt.Sprintf("API endpoint FAILOVER: %s -> %s after %d consecutive failure(s).", current.baseURL, p.endpoints[next].baseURL, p.failures))
+	p.active = next
+	p.failures = 0
+}
+
+// runEndpointProbes sonda as URLs da API a cada healthProbeInterval até stop ser fechado.
+func runEndpointProbes(stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(healthProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			apiEndpoints.probeAll()
+		}
+	}
+}
+
+// probeAll sonda cada endpoint e volta para o mais preferido que se recuperou.
+func (p *endpointPool) probeAll() {
+	p.mu.Lock()
+	baseURLs := make([]string, len(p.endpoints))
+	for i, endpoint := range p.endpoints {
+		baseURLs[i] = endpoint.baseURL
+	}
+	p.mu.Unlock()
+
+	// As sondas rodam sem o mutex, para não travar as chamadas à API
+	results := make([]bool, len(baseURLs))
+	for i, baseURL := range baseURLs {
+		results[i] = probeEndpoint(baseURL + p.healthPath)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, endpoint := range p.endpoints {
+		if results[i] {
+			endpoint.successes++
+		} else {
+			if endpoint.healthy {
+				globalLogger.Println(fmt.Sprintf("WARNING: API endpoint %s failed its health probe.", endpoint.baseURL))
+			}
+			endpoint.successes = 0
+		}
+		endpoint.healthy = results[i]
+	}
+	for i := 0; i < p.active; i++ {
+		if p.endpoints[i].successes >= failbackProbes {
+			globalLogger.Println(fmt.Sprintf("API endpoint FAILBACK: %s -> %s (recovered, %d successful probe(s)).", p.endpoints[p.active].baseURL, p.endpoints[i].baseURL, p.endpoints[i].successes))
+			p.active = i
+			p.failures = 0
+			// O circuito aberto pelas falhas dos outros endpoints não vale para o recuperado. Na
+			// troca por falhas ele não é fechado: com todas as URLs fora, ele precisa abrir.
+			apiBreaker.Reset()
+			return
+		}
+	}
+}
+
+// probeEndpoint informa se a URL responde. Qualquer resposta abaixo de 500 conta: a sonda só
+// quer saber se o servidor da API está no ar, não se a rota existe ou exige credenciais.
+func probeEndpoint(probeURL string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return false
+	}
+	closeResponse(resp)
+	return resp.StatusCode < http.StatusInternalServerError
+}
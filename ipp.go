@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Operações IPP tratadas pelo proxy (RFC 8011).
+const (
+	ippOpPrintJob     = 0x0002
+	ippOpCreateJob    = 0x0005
+	ippOpSendDocument = 0x0006
+)
+
+// Tags de delimitação dos grupos de atributos.
+const (
+	ippTagOperation  = 0x01
+	ippTagJob        = 0x02
+	ippTagEnd        = 0x03
+	ippTagDelimiters = 0x0f // Tags até este valor são delimitadores, não valores
+)
+
+// Tags de valor usadas na leitura dos atributos.
+const (
+	ippTagInteger = 0x21
+	ippTagBoolean = 0x22
+	ippTagEnum    = 0x23
+)
+
+// ippMaxAttributes limita o cabeçalho aceito, para não bufferizar uma mensagem malformada.
+const ippMaxAttributes = 4096
+
+// ippValue é um valor de atributo com sua tag. Coleções aparecem como uma sequência de valores
+// sem nome, que é preservada como veio.
+type ippValue struct {
+	tag  byte
+	data []byte
+}
+
+// ippAttribute é um atributo de um grupo.
+type ippAttribute struct {
+	group  byte
+	name   string
+	values []ippValue
+}
+
+// ippMessage é o cabeçalho de uma requisição ou resposta IPP, sem os dados do documento.
+type ippMessage struct {
+	version   [2]byte
+	code      uint16 // Operação (requisição) ou status (resposta)
+	requestID uint32
+	attrs     []*ippAttribute
+	size      int64 // Bytes lidos do fluxo original até o fim dos atributos
+}
+
+// readIPPMessage lê o cabeçalho e os atributos até a tag end-of-attributes. O que vem depois
+// (os dados do documento) fica em r.
+func readIPPMessage(r *bufio.Reader) (*ippMessage, error) {
+	msg := &ippMessage{}
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("failed to read IPP header: %w", err)
+	}
+	copy(msg.version[:], head[:2])
+	msg.code = binary.BigEndian.Uint16(head[2:4])
+	msg.requestID = binary.BigEndian.Uint32(head[4:8])
+	msg.size = 8
+
+	var group byte
+	var last *ippAttribute
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("IPP attributes ended without end-of-attributes tag: %w", err)
+		}
+		msg.size++
+		if tag == ippTagEnd {
+			return msg, nil
+		}
+		if tag <= ippTagDelimiters {
+			group = tag
+			last = nil
+			continue
+		}
+
+		name, err := readIPPField(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readIPPField(r)
+		if err != nil {
+			return nil, err
+		}
+		msg.size += int64(4 + len(name) + len(value))
+
+		if len(name) == 0 {
+			if last == nil {
+				return nil, errors.New("IPP additional value without attribute")
+			}
+			last.values = append(last.values, ippValue{tag: tag, data: value})
+			continue
+		}
+		if len(msg.attrs) >= ippMaxAttributes {
+			return nil, errors.New("too many IPP attributes")
+		}
+		last = &ippAttribute{group: group, name: string(name), values: []ippValue{{tag: tag, data: value}}}
+		msg.attrs = append(msg.attrs, last)
+	}
+}
+
+// readIPPField lê um campo com prefixo de tamanho de 2 bytes.
+func readIPPField(r *bufio.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, fmt.Errorf("truncated IPP attribute: %w", err)
+	}
+	field := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, fmt.Errorf("truncated IPP attribute: %w", err)
+	}
+	return field, nil
+}
+
+// encode serializa o cabeçalho e os atributos, terminando com end-of-attributes.
+func (m *ippMessage) encode() []byte {
+	out := make([]byte, 0, m.size+16)
+	out = append(out, m.version[:]...)
+	out = binary.BigEndian.AppendUint16(out, m.code)
+	out = binary.BigEndian.AppendUint32(out, m.requestID)
+	var group byte
+	for _, attr := range m.attrs {
+		if attr.group != group {
+			group = attr.group
+			out = append(out, group)
+		}
+		for i, v := range attr.values {
+			name := attr.name
+			if i > 0 {
+				name = ""
+			}
+			out = append(out, v.tag)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(name)))
+			out = append(out, name...)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(v.data)))
+			out = append(out, v.data...)
+		}
+	}
+	return append(out, ippTagEnd)
+}
+
+// find retorna o primeiro atributo com o nome dado no grupo (0 para qualquer grupo).
+func (m *ippMessage) find(group byte, name string) *ippAttribute {
+	for _, attr := range m.attrs {
+		if attr.name == name && (group == 0 || attr.group == group) {
+			return attr
+		}
+	}
+	return nil
+}
+
+// str retorna o primeiro valor textual do atributo, ou "".
+func (m *ippMessage) str(group byte, name string) string {
+	if attr := m.find(group, name); attr != nil {
+		return string(attr.values[0].data)
+	}
+	return ""
+}
+
+// int retorna o primeiro valor inteiro (integer ou enum) do atributo.
+func (m *ippMessage) int(group byte, name string) (int, bool) {
+	attr := m.find(group, name)
+	if attr == nil {
+		return 0, false
+	}
+	v := attr.values[0]
+	if (v.tag != ippTagInteger && v.tag != ippTagEnum) || len(v.data) != 4 {
+		return 0, false
+	}
+	return int(int32(binary.BigEndian.Uint32(v.data))), true
+}
+
+// bool retorna o primeiro valor booleano do atributo.
+func (m *ippMessage) bool(group byte, name string) (bool, bool) {
+	attr := m.find(group, name)
+	if attr == nil || attr.values[0].tag != ippTagBoolean || len(attr.values[0].data) != 1 {
+		return false, false
+	}
+	return attr.values[0].data[0] != 0, true
+}
+
+// ippSuccess informa se o status de uma resposta é de sucesso (0x0000-0x00FF).
+func ippSuccess(status uint16) bool {
+	return status <= 0x00ff
+}
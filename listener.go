@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tipos de listener aceitos em ListenerConfig.Type.
+const (
+	listenerTypeRaw = "raw" // Proxy TCP porta 9100 (RAW/JetDirect)
+	listenerTypeLPD = "lpd" // Servidor LPD (RFC 1179)
+	listenerTypeIPP = "ipp" // Proxy IPP (Print-Job, Create-Job/Send-Document)
+)
+
+// listenerIdleTimeout encerra conexões de clientes que pararam de enviar dados.
+const listenerIdleTimeout = 5 * time.Minute
+
+// listenerRetryInterval é o intervalo entre tentativas de abrir a porta de escuta.
+const listenerRetryInterval = 30 * time.Second
+
+// listenerMaxConnections limita as conexões atendidas ao mesmo tempo por listener. Acima disso,
+// novas conexões esperam na fila do sistema até uma ser encerrada.
+const listenerMaxConnections = 64
+
+// listenerQueueSize é o número de jobs que aguardam envio à API em cada listener. Com a fila
+// cheia (API lenta ou fora), os jobs vão direto para a fila de pendências em disco.
+const listenerQueueSize = 256
+
+// jobListener é um modo de captura em que os jobs chegam pela rede, em vez de serem lidos de
+// arquivos de log. Cada conexão aceita é entregue a Serve, que chama emit para cada job.
+type jobListener interface {
+	// Name identifica o listener nos logs do serviço.
+	Name() string
+	// Serve atende uma conexão de cliente até o fim.
+	Serve(conn net.Conn, emit func(PrintData))
+}
+
+// configuredListener liga um listener à configuração de onde ele foi criado.
+type configuredListener struct {
+	cfg *ListenerConfig
+	l   jobListener
+}
+
+// newJobListeners cria um jobListener para cada entrada de cfg.Listeners. Entradas inválidas
+// são logadas e ignoradas, como as fontes de log.
+func newJobListeners(cfg *Config) []configuredListener {
+	var listeners []configuredListener
+	for i := range cfg.Listeners {
+		lc := &cfg.Listeners[i]
+		l, err := newJobListener(lc)
+		if err != nil {
+			globalLogger.Println(fmt.Sprintf("ERROR: Ignoring listener %d ('%s'): %v", i, lc.Listen, err))
+			continue
+		}
+		listeners = append(listeners, configuredListener{cfg: lc, l: l})
+	}
+	return listeners
+}
+
+// newJobListener cria o listener configurado em lc.Type.
+func newJobListener(lc *ListenerConfig) (jobListener, error) {
+	if lc.Listen == "" {
+		return nil, fmt.Errorf("listen address is required")
+	}
+	switch strings.ToLower(lc.Type) {
+	case listenerTypeRaw:
+		return newRawListener(lc)
+	case listenerTypeLPD:
+		return newLPDListener(lc)
+	case listenerTypeIPP:
+		return newIPPListener(lc)
+	}
+	return nil, fmt.Errorf("unknown listener type '%s' (expected '%s', '%s' or '%s')", lc.Type, listenerTypeRaw, listenerTypeLPD, listenerTypeIPP)
+}
+
+// runJobListener abre a porta do listener e atende as conexões até stop ser fechado. Se a porta
+// não puder ser aberta (ex: já em uso), tenta de novo a cada listenerRetryInterval.
+func runJobListener(cfg *Config, listener configuredListener, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	name := listener.l.Name()
+	var ln net.Listener
+	for {
+		var err error
+		ln, err = net.Listen("tcp", listener.cfg.Listen)
+		if err == nil {
+			break
+		}
+		globalLogger.Println(fmt.Sprintf("ERROR: Listener %s could not listen on '%s': %v. Retrying in %s.", name, listener.cfg.Listen, err, listenerRetryInterval))
+		elog.Warning(1, fmt.Sprintf("Listener %s could not listen on '%s': %v", name, listener.cfg.Listen, err))
+		select {
+		case <-stop:
+			return
+		case <-time.After(listenerRetryInterval):
+		}
+	}
+	globalLogger.Println(fmt.Sprintf("Listener %s accepting jobs on %s.", name, ln.Addr()))
+
+	go func() {
+		<-stop
+		ln.Close()
+	}()
+
+	// O envio à API roda fora das conexões: o cliente recebe a confirmação sem esperar pela API
+	queue := newDeliveryQueue(cfg, "listener "+name, listenerQueueSize)
+	defer queue.Close()
+
+	slots := make(chan struct{}, listenerMaxConnections)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-stop:
+			return
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			<-slots
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			globalLogger.Println(fmt.Sprintf("WARNING: Listener %s failed to accept a connection: %v", name, err))
+			time.Sleep(time.Second)
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			defer conn.Close()
+			defer func() {
+				if r := recover(); r != nil {
+					globalLogger.Println(fmt.Sprintf("CRITICAL: Panic while serving %s connection from %s: %v", name, conn.RemoteAddr(), r))
+				}
+			}()
+			listener.l.Serve(&idleConn{Conn: conn}, queue.Enqueue)
+		}()
+	}
+}
+
+// deliveryQueue envia à API, em uma goroutine própria, os jobs capturados por um listener.
+type deliveryQueue struct {
+	cfg    *Config
+	source string
+	jobs   chan PrintData
+	done   chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	stopping atomic.Bool
+}
+
+// newDeliveryQueue cria a fila e inicia o envio.
+func newDeliveryQueue(cfg *Config, source string, size int) *deliveryQueue {
+	q := &deliveryQueue{cfg: cfg, source: source, jobs: make(chan PrintData, size), done: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+// Enqueue coloca o job na fila sem bloquear. Com a fila cheia ou fechada, o job é gravado na
+// fila de pendências, de onde será reenviado no próximo ciclo.
+func (q *deliveryQueue) Enqueue(data PrintData) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		select {
+		case q.jobs <- data:
+			return
+		default:
+			globalLogger.Println(fmt.Sprintf("WARNING: Delivery queue of %s is full (%d jobs). Saving job to the pending queue.", q.source, cap(q.jobs)))
+		}
+	}
+	q.savePending(data)
+}
+
+// Close para de aceitar jobs e espera o envio terminar. Os jobs que ainda estavam na fila vão
+// para a fila de pendências, sem esperar pela API.
+func (q *deliveryQueue) Close() {
+	q.stopping.Store(true)
+	q.mu.Lock()
+	q.closed = true
+	close(q.jobs)
+	q.mu.Unlock()
+	<-q.done
+}
+
+// run envia os jobs da fila, um por vez, até a fila ser fechada.
+func (q *deliveryQueue) run() {
+	defer close(q.done)
+	for data := range q.jobs {
+		if q.stopping.Load() {
+			q.savePending(data)
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					globalLogger.Println(fmt.Sprintf("CRITICAL: Panic while delivering job from %s: %v", q.source, r))
+				}
+			}()
+			deliverImpression(q.cfg, data, q.source)
+		}()
+	}
+}
+
+// savePending grava o job na fila de pendências.
+func (q *deliveryQueue) savePending(data PrintData) {
+	if err := savePendingImpression(data); err != nil {
+		globalLogger.Println(fmt.Sprintf("CRITICAL_ERROR: FAILED TO SAVE PENDING IMPRESSION for user %s (%s). Data may be lost. Error: %v", data.Usuario, q.source, err))
+	}
+}
+
+// firstNonEmpty retorna o primeiro valor não vazio.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// sumPDLJobs soma páginas e bytes de jobs que formam um só job (arquivos de um job LPD,
+// documentos de um job IPP), mantendo os primeiros dados de identificação encontrados.
+func sumPDLJobs(jobs []pdlJob) pdlJob {
+	var sum pdlJob
+	for _, job := range jobs {
+		sum.pages += job.pages
+		sum.bytes += job.bytes
+		sum = mergePDLJob(sum, job)
+	}
+	return sum
+}
+
+// mergePDLJob copia de from os campos de identificação que ainda estão vazios em to.
+func mergePDLJob(to, from pdlJob) pdlJob {
+	to.user = firstNonEmpty(to.user, from.user)
+	to.host = firstNonEmpty(to.host, from.host)
+	to.name = firstNonEmpty(to.name, from.name)
+	to.paper = firstNonEmpty(to.paper, from.paper)
+	to.color = firstNonEmpty(to.color, from.color)
+	to.duplex = firstNonEmpty(to.duplex, from.duplex)
+	to.language = firstNonEmpty(to.language, from.language)
+	if from.copies > to.copies {
+		to.copies = from.copies
+	}
+	return to
+}
+
+// idleConn renova o prazo de leitura a cada Read, encerrando clientes parados.
+type idleConn struct {
+	net.Conn
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(listenerIdleTimeout))
+	return c.Conn.Read(p)
+}
+
+// remoteHost retorna o IP do cliente da conexão.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// jobPrintData converte um job capturado pela rede em PrintData. Os dados informados pelo
+// protocolo (proto: fila LPD, atributos IPP) prevalecem sobre os extraídos do fluxo (job); o
+// IP do cliente é usado quando nenhum dos dois traz o nome da máquina.
+func jobPrintData(lc *ListenerConfig, job, proto pdlJob, clientHost string) PrintData {
+	documentName := firstNonEmpty(proto.name, job.name)
+	fileExtension := strings.TrimPrefix(filepath.Ext(documentName), ".")
+	copies := job.copies
+	if proto.copies > 1 {
+		copies = proto.copies
+	}
+	now := time.Now()
+
+	// --- Capturar informações de rede ---
+	ip, mac, err := getNetworkInfo()
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not get network info: %v. IP and MAC will be empty.", err))
+	}
+
+	// Jobs de rede não são relidos: o ID só precisa ser único e acompanhar o job na fila de
+	// pendências, então o "offset" é o instante da captura
+	jobID := recordJobID("listener "+lc.Listen, now.UnixNano(), []byte(clientHost+"\x00"+documentName))
+
+	return PrintData{
+		JobID:       jobID,
+		Data:        now.Format("2006-01-02"),
+		Hora:        now.Format("15:04:05"),
+		Timestamp:   now.Format(time.RFC3339),
+		Usuario:     firstNonEmpty(proto.user, job.user),
+		Setor:       lc.Setor,
+		Paginas:     job.pages,
+		Copias:      copies,
+		Impressora:  firstNonEmpty(lc.Printer, lc.Upstream),
+		NomeArquivo: documentName,
+		Tipo:        fileExtension,
+		NomePC:      firstNonEmpty(proto.host, job.host, clientHost),
+		TipoPage:    firstNonEmpty(proto.paper, job.paper),
+		Cor:         firstNonEmpty(proto.color, job.color),
+		Duplex:      firstNonEmpty(proto.duplex, job.duplex),
+		Tamanho:     fmt.Sprintf("%d", job.bytes),
+		IP:          ip,
+		MAC:         mac,
+		IDEmpresa:   lc.IDEmpresa,
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ippResponseTimeout limita a espera pela resposta do servidor IPP de destino, contada a partir
+// do fim do envio do documento.
+const ippResponseTimeout = 5 * time.Minute
+
+// ippRequestTimeout limita cada requisição ao destino do início ao fim, incluindo o envio do
+// documento e a leitura da resposta, para que um destino travado não prenda a conexão.
+const ippRequestTimeout = 30 * time.Minute
+
+// ippIdleConnTimeout fecha as conexões com o destino que ficaram paradas entre requisições.
+const ippIdleConnTimeout = 90 * time.Second
+
+// ippMaxResponse limita a resposta lida para extrair o job-id e o status.
+const ippMaxResponse = 1 << 20
+
+// ippPendingTTL é quanto tempo um job criado por Create-Job espera pelo último documento.
+const ippPendingTTL = time.Hour
+
+// hopByHopHeaders não são repassados entre as duas conexões HTTP.
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Expect"}
+
+// ippPendingJob é um job aberto por Create-Job que ainda recebe documentos.
+type ippPendingJob struct {
+	proto   pdlJob
+	stream  pdlJob
+	created time.Time
+}
+
+// ippListener é um proxy IPP: repassa as requisições HTTP para o servidor IPP de destino e
+// registra os jobs aceitos por ele (Print-Job, ou Create-Job seguido de Send-Document).
+type ippListener struct {
+	cfg         *ListenerConfig
+	upstream    *url.URL // Endereço HTTP(S) do destino
+	upstreamURI string   // O mesmo destino como ipp:// ou ipps://, usado em printer-uri
+	client      *http.Client
+
+	mu   sync.Mutex
+	jobs map[int]*ippPendingJob
+}
+
+func newIPPListener(lc *ListenerConfig) (*ippListener, error) {
+	upstream, upstreamURI, err := parseIPPUpstream(lc.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	return &ippListener{
+		cfg:         lc,
+		upstream:    upstream,
+		upstreamURI: upstreamURI,
+		client: &http.Client{
+			Timeout: ippRequestTimeout,
+			Transport: &http.Transport{
+				DialContext:           (&net.Dialer{Timeout: rawDialTimeout}).DialContext,
+				TLSHandshakeTimeout:   rawDialTimeout,
+				ResponseHeaderTimeout: ippResponseTimeout,
+				IdleConnTimeout:       ippIdleConnTimeout,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse // Redirecionamentos voltam para o cliente
+			},
+		},
+		jobs: make(map[int]*ippPendingJob),
+	}, nil
+}
+
+// parseIPPUpstream aceita ipp://, ipps://, http:// e https://. Retorna o endereço HTTP para as
+// requisições e a URI ipp(s) do destino.
+func parseIPPUpstream(value string) (*url.URL, string, error) {
+	if value == "" {
+		return nil, "", fmt.Errorf("upstream IPP URL is required for '%s' listeners", listenerTypeIPP)
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid upstream IPP URL '%s'", value)
+	}
+
+	target := *u
+	switch strings.ToLower(u.Scheme) {
+	case "ipp", "ipps":
+		target.Scheme = "http"
+		if strings.EqualFold(u.Scheme, "ipps") {
+			target.Scheme = "https"
+		}
+		if u.Port() == "" {
+			target.Host = net.JoinHostPort(u.Hostname(), "631")
+		}
+		return &target, u.String(), nil
+	case "http", "https":
+		uri := *u
+		uri.Scheme = "ipp"
+		if strings.EqualFold(u.Scheme, "https") {
+			uri.Scheme = "ipps"
+		}
+		return &target, uri.String(), nil
+	}
+	return nil, "", fmt.Errorf("unsupported upstream scheme '%s' (expected ipp, ipps, http or https)", u.Scheme)
+}
+
+func (l *ippListener) Name() string {
+	if l.cfg.Name != "" {
+		return l.cfg.Name
+	}
+	return "ipp " + l.cfg.Listen
+}
+
+// Serve atende as requisições HTTP de uma conexão (com keep-alive) até o cliente encerrá-la.
+func (l *ippListener) Serve(conn net.Conn, emit func(PrintData)) {
+	reader := bufio.NewReader(conn)
+	client := remoteHost(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			if _, err := io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+				return
+			}
+		}
+
+		resp, job := l.forward(req, client)
+		err = resp.Write(conn)
+		resp.Body.Close()
+		// O job aceito é registrado só depois da resposta, para o cliente não esperar pela API
+		if job != nil {
+			emit(*job)
+		}
+		io.Copy(io.Discard, req.Body) // Descarta o que o destino não leu, para a próxima requisição
+		req.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// forward repassa uma requisição ao destino. Em requisições IPP, printer-uri é reescrito para o
+// destino e o documento tem as páginas contadas no caminho. Retorna também o registro do job,
+// quando a requisição conclui um job aceito pelo destino.
+func (l *ippListener) forward(req *http.Request, client string) (*http.Response, *PrintData) {
+	target := *l.upstream
+	var body io.Reader = req.Body
+	length := req.ContentLength
+
+	var msg *ippMessage
+	var counter *documentCounter
+	isIPP := req.Method == http.MethodPost && strings.HasPrefix(req.Header.Get("Content-Type"), "application/ipp")
+	if isIPP {
+		reader := bufio.NewReader(req.Body)
+		var err error
+		msg, err = readIPPMessage(reader)
+		if err != nil {
+			globalLogger.Println(fmt.Sprintf("WARNING: %s received an invalid IPP request from %s: %v", l.Name(), client, err))
+			return ippErrorResponse(req, http.StatusBadRequest, err.Error()), nil
+		}
+		if attr := msg.find(ippTagOperation, "printer-uri"); attr != nil {
+			attr.values[0].data = []byte(l.upstreamURI)
+		}
+		header := msg.encode()
+
+		var document io.Reader = reader
+		if msg.code == ippOpPrintJob || msg.code == ippOpSendDocument {
+			counter = newDocumentCounter()
+			document = io.TeeReader(reader, counter)
+		}
+		body = io.MultiReader(bytes.NewReader(header), document)
+		if length >= 0 {
+			length += int64(len(header)) - msg.size
+		}
+	} else {
+		// Demais requisições (página web, ícones) vão para o mesmo caminho no destino
+		target.Path = req.URL.Path
+		target.RawQuery = req.URL.RawQuery
+	}
+
+	out, err := http.NewRequest(req.Method, target.String(), body)
+	if err != nil {
+		return ippErrorResponse(req, http.StatusBadGateway, err.Error()), nil
+	}
+	out.Header = req.Header.Clone()
+	for _, h := range hopByHopHeaders {
+		out.Header.Del(h)
+	}
+	out.ContentLength = length
+	if length == 0 {
+		out.Body = http.NoBody
+	}
+
+	resp, err := l.client.Do(out)
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("ERROR: %s could not forward request from %s to '%s': %v", l.Name(), client, target.String(), err))
+		return ippErrorResponse(req, http.StatusBadGateway, err.Error()), nil
+	}
+	for _, h := range hopByHopHeaders {
+		resp.Header.Del(h)
+	}
+
+	if msg != nil && (msg.code == ippOpPrintJob || msg.code == ippOpCreateJob || msg.code == ippOpSendDocument) {
+		// A resposta dessas operações é pequena: lida inteira para saber o status e o job-id
+		data, err := io.ReadAll(io.LimitReader(resp.Body, ippMaxResponse))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		resp.ContentLength = int64(len(data))
+		resp.TransferEncoding = nil
+		if err != nil {
+			globalLogger.Println(fmt.Sprintf("WARNING: %s failed to read IPP response for %s: %v", l.Name(), client, err))
+			return resp, nil
+		}
+		if reply, err := readIPPMessage(bufio.NewReader(bytes.NewReader(data))); err == nil && resp.StatusCode == http.StatusOK && ippSuccess(reply.code) {
+			return resp, l.record(msg, reply, counter, client)
+		}
+	}
+	return resp, nil
+}
+
+// record acompanha o ciclo de vida do job: Print-Job é registrado na hora; Create-Job abre um
+// job que é registrado quando chega o Send-Document com last-document. Retorna o registro do
+// job concluído, ou nil se o job ainda espera documentos.
+func (l *ippListener) record(req, reply *ippMessage, counter *documentCounter, client string) *PrintData {
+	var stream pdlJob
+	if counter != nil {
+		stream = sumPDLJobs(counter.Jobs())
+	}
+
+	switch req.code {
+	case ippOpPrintJob:
+		return l.jobData(ippProto(req), stream, client)
+	case ippOpCreateJob:
+		jobID, ok := reply.int(ippTagJob, "job-id")
+		if !ok {
+			return nil
+		}
+		l.mu.Lock()
+		for id, job := range l.jobs {
+			if time.Since(job.created) > ippPendingTTL {
+				delete(l.jobs, id)
+			}
+		}
+		l.jobs[jobID] = &ippPendingJob{proto: ippProto(req), created: time.Now()}
+		l.mu.Unlock()
+	case ippOpSendDocument:
+		jobID, ok := req.int(ippTagOperation, "job-id")
+		if !ok {
+			jobID, ok = ippJobIDFromURI(req.str(ippTagOperation, "job-uri"))
+		}
+		if !ok {
+			return nil
+		}
+		l.mu.Lock()
+		job := l.jobs[jobID]
+		if job == nil {
+			// Create-Job anterior ao início do agente: usa os atributos do próprio Send-Document
+			job = &ippPendingJob{proto: ippProto(req), created: time.Now()}
+			l.jobs[jobID] = job
+		}
+		job.stream = sumPDLJobs([]pdlJob{job.stream, stream})
+		last, _ := req.bool(ippTagOperation, "last-document")
+		if last {
+			delete(l.jobs, jobID)
+		}
+		l.mu.Unlock()
+		if last {
+			return l.jobData(job.proto, job.stream, client)
+		}
+	}
+	return nil
+}
+
+// jobData monta o registro de um job concluído.
+func (l *ippListener) jobData(proto, stream pdlJob, client string) *PrintData {
+	if stream.pages == 0 {
+		stream.pages = 1 // Documento sem contagem reconhecível (ex: formato raster desconhecido)
+	}
+	globalLogger.Println(fmt.Sprintf("%s: job '%s' from %s (user '%s'): %d page(s), %d copy(ies).", l.Name(), proto.name, client, proto.user, stream.pages, max(proto.copies, 1)))
+	data := jobPrintData(l.cfg, stream, proto, client)
+	return &data
+}
+
+// ippProto extrai os dados do job dos atributos da requisição.
+func ippProto(msg *ippMessage) pdlJob {
+	proto := pdlJob{
+		user:  msg.str(ippTagOperation, "requesting-user-name"),
+		name:  firstNonEmpty(msg.str(ippTagOperation, "job-name"), msg.str(ippTagOperation, "document-name")),
+		paper: msg.str(ippTagJob, "media"),
+	}
+	if copies, ok := msg.int(ippTagJob, "copies"); ok {
+		proto.copies = copies
+	}
+	switch mode := msg.str(ippTagJob, "print-color-mode"); {
+	case strings.Contains(mode, "monochrome") || mode == "bi-level":
+		proto.color = "GRAYSCALE"
+	case mode == "color":
+		proto.color = "NOT GRAYSCALE"
+	}
+	switch sides := msg.str(ippTagJob, "sides"); {
+	case sides == "one-sided":
+		proto.duplex = "NOT DUPLEX"
+	case strings.HasPrefix(sides, "two-sided"):
+		proto.duplex = "DUPLEX"
+	}
+	return proto
+}
+
+// ippJobIDFromURI extrai o número do job de uma job-uri (ex: ipp://host/jobs/42).
+func ippJobIDFromURI(uri string) (int, bool) {
+	i := strings.LastIndexByte(uri, '/')
+	if i < 0 {
+		return 0, false
+	}
+	id, err := strconv.Atoi(uri[i+1:])
+	return id, err == nil
+}
+
+// ippErrorResponse monta uma resposta HTTP de erro para o cliente.
+func ippErrorResponse(req *http.Request, status int, text string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(text)),
+		ContentLength: int64(len(text)),
+		Close:         true,
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Comandos e subcomandos do LPD (RFC 1179).
+const (
+	lpdCmdPrintWaiting = 0x01
+	lpdCmdReceiveJob   = 0x02
+	lpdCmdQueueShort   = 0x03
+	lpdCmdQueueLong    = 0x04
+	lpdCmdRemoveJobs   = 0x05
+
+	lpdSubAbort       = 0x01
+	lpdSubControlFile = 0x02
+	lpdSubDataFile    = 0x03
+)
+
+// Repasse dos jobs recebidos em ListenerConfig.Relay.
+const (
+	lpdRelayNone = ""
+	lpdRelayLPD  = "lpd"
+	lpdRelayRaw  = "raw"
+)
+
+// lpdMaxLine limita o tamanho das linhas de comando do protocolo.
+const lpdMaxLine = 1024
+
+// lpdMaxControlFile limita o arquivo de controle, lido em memória; os reais têm poucas linhas.
+const lpdMaxControlFile = 64 << 10
+
+// lpdDefaultMaxDataFileMB é o tamanho máximo de um arquivo de dados quando
+// ListenerConfig.MaxDataFileMB não é informado.
+const lpdDefaultMaxDataFileMB = 512
+
+// errLPDFileTooLarge indica um arquivo do job maior que o limite aceito.
+var errLPDFileTooLarge = errors.New("file exceeds the size limit")
+
+// lpdControl é o arquivo de controle de um job LPD.
+type lpdControl struct {
+	host    string   // H
+	user    string   // P
+	jobName string   // J
+	title   string   // T
+	source  string   // N: nome do arquivo de origem
+	prints  []string // Arquivos de dados, uma vez por cópia (linhas f, l, o, p...)
+	content []byte
+	name    string
+}
+
+// lpdJob é um job em recebimento: arquivo de controle e arquivos de dados já gravados no spool.
+type lpdJob struct {
+	queue   string
+	dir     string
+	control *lpdControl
+	data    map[string]string // Nome do arquivo de dados -> caminho no spool
+	order   []string
+	scanned map[string][]pdlJob
+}
+
+// lpdListener é um servidor LPD que recebe jobs de clientes LPR, opcionalmente os repassa para
+// outro servidor LPD ou para a porta 9100 da impressora, e registra cada job.
+type lpdListener struct {
+	cfg      *ListenerConfig
+	spoolDir string
+}
+
+func newLPDListener(lc *ListenerConfig) (*lpdListener, error) {
+	switch strings.ToLower(lc.Relay) {
+	case lpdRelayNone:
+	case lpdRelayLPD, lpdRelayRaw:
+		if lc.Upstream == "" {
+			return nil, fmt.Errorf("upstream address is required to relay jobs via '%s'", lc.Relay)
+		}
+	default:
+		return nil, fmt.Errorf("unknown relay '%s' (expected '%s' or '%s')", lc.Relay, lpdRelayLPD, lpdRelayRaw)
+	}
+
+	spoolDir := filepath.Join(os.Getenv("PROGRAMDATA"), "PrintWatchServiceLogs", "lpd-spool")
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create LPD spool directory '%s': %w", spoolDir, err)
+	}
+	return &lpdListener{cfg: lc, spoolDir: spoolDir}, nil
+}
+
+func (l *lpdListener) Name() string {
+	if l.cfg.Name != "" {
+		return l.cfg.Name
+	}
+	return "lpd " + l.cfg.Listen
+}
+
+// Serve atende um comando LPD. Só "receive a printer job" gera registro; consultas de fila
+// recebem uma fila vazia e os demais comandos são ignorados.
+func (l *lpdListener) Serve(conn net.Conn, emit func(PrintData)) {
+	reader := bufio.NewReader(conn)
+	line, err := readLPDLine(reader)
+	if err != nil || len(line) == 0 {
+		return
+	}
+	command, operands := line[0], strings.Fields(line[1:])
+	queue := ""
+	if len(operands) > 0 {
+		queue = operands[0]
+	}
+
+	switch command {
+	case lpdCmdReceiveJob:
+		if l.cfg.Queue != "" && !strings.EqualFold(queue, l.cfg.Queue) {
+			globalLogger.Println(fmt.Sprintf("WARNING: %s rejected job from %s for unknown queue '%s'.", l.Name(), remoteHost(conn), queue))
+			conn.Write([]byte{1})
+			return
+		}
+		conn.Write([]byte{0})
+		l.receiveJob(conn, reader, queue, emit)
+	case lpdCmdQueueShort, lpdCmdQueueLong:
+		conn.Write([]byte("no entries\n"))
+	case lpdCmdPrintWaiting, lpdCmdRemoveJobs:
+		// Nada fica em fila no agente
+	}
+}
+
+// receiveJob recebe os subcomandos de um ou mais jobs (a RFC 1179 permite vários jobs no mesmo
+// comando, e clientes como LPRng e o LPR do Windows os enviam assim). Cada job é repassado assim
+// que o arquivo de controle e todos os arquivos de dados citados nele chegam, antes de confirmar
+// o último arquivo: se o repasse falhar, o cliente recebe uma resposta negativa e o spooler dele
+// tenta de novo. O registro só é entregue (à fila de envio do listener) depois da confirmação.
+func (l *lpdListener) receiveJob(conn net.Conn, reader *bufio.Reader, queue string, emit func(PrintData)) {
+	client := remoteHost(conn)
+	job, err := l.newJob(queue)
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("ERROR: %s could not create spool directory for job from %s: %v", l.Name(), client, err))
+		return
+	}
+	defer func() { os.RemoveAll(job.dir) }()
+
+	for {
+		line, err := readLPDLine(reader)
+		if err != nil || len(line) == 0 {
+			switch {
+			case err == io.EOF && job.complete():
+				// O último arquivo foi enviado "até o fim da conexão": não há confirmação a dar
+				if data, ok := l.finishJob(job, client); ok {
+					emit(data)
+				}
+			case job.control != nil || len(job.data) > 0:
+				globalLogger.Println(fmt.Sprintf("WARNING: %s job from %s ended before all files arrived. Discarding it.", l.Name(), client))
+			}
+			return
+		}
+
+		switch line[0] {
+		case lpdSubAbort:
+			return
+		case lpdSubControlFile, lpdSubDataFile:
+			size, name, err := parseLPDFileHeader(line[1:])
+			if err != nil {
+				globalLogger.Println(fmt.Sprintf("WARNING: %s received an invalid subcommand from %s: %v", l.Name(), client, err))
+				conn.Write([]byte{1})
+				return
+			}
+			control := line[0] == lpdSubControlFile
+			if size > l.maxFileSize(control) {
+				globalLogger.Println(fmt.Sprintf("WARNING: %s rejected '%s' from %s: %d bytes exceeds the limit of %d.", l.Name(), name, client, size, l.maxFileSize(control)))
+				conn.Write([]byte{1})
+				return
+			}
+			conn.Write([]byte{0})
+
+			if err := l.receiveFile(reader, job, control, name, size); err != nil {
+				globalLogger.Println(fmt.Sprintf("ERROR: %s failed to receive '%s' from %s: %v", l.Name(), name, client, err))
+				if errors.Is(err, errLPDFileTooLarge) {
+					conn.Write([]byte{1})
+				}
+				return
+			}
+			if size == 0 {
+				continue // Recebido até o fim da conexão
+			}
+			if !job.complete() {
+				conn.Write([]byte{0})
+				continue
+			}
+			data, ok := l.finishJob(job, client)
+			if !ok {
+				conn.Write([]byte{1})
+				return
+			}
+			// O cliente é confirmado antes do registro, para não esperar pela API
+			conn.Write([]byte{0})
+			emit(data)
+
+			// Os próximos arquivos da conexão pertencem a um novo job
+			os.RemoveAll(job.dir)
+			next, err := l.newJob(queue)
+			if err != nil {
+				globalLogger.Println(fmt.Sprintf("ERROR: %s could not create spool directory for job from %s: %v", l.Name(), client, err))
+				return
+			}
+			job = next
+		default:
+			globalLogger.Println(fmt.Sprintf("WARNING: %s received unknown subcommand 0x%02x from %s.", l.Name(), line[0], client))
+			conn.Write([]byte{1})
+			return
+		}
+	}
+}
+
+// newJob cria um job vazio com seu próprio diretório no spool.
+func (l *lpdListener) newJob(queue string) (*lpdJob, error) {
+	dir, err := os.MkdirTemp(l.spoolDir, "job-")
+	if err != nil {
+		return nil, err
+	}
+	return &lpdJob{queue: queue, dir: dir, data: make(map[string]string), scanned: make(map[string][]pdlJob)}, nil
+}
+
+// maxFileSize é o maior arquivo de controle ou de dados aceito em um job.
+func (l *lpdListener) maxFileSize(control bool) int64 {
+	if control {
+		return lpdMaxControlFile
+	}
+	if l.cfg.MaxDataFileMB > 0 {
+		return int64(l.cfg.MaxDataFileMB) << 20
+	}
+	return lpdDefaultMaxDataFileMB << 20
+}
+
+// receiveFile grava um arquivo do job no spool. As páginas dos arquivos de dados são contadas
+// no caminho. size 0 significa "até o fim da conexão"; nesse caso, passar de maxFileSize
+// retorna errLPDFileTooLarge.
+func (l *lpdListener) receiveFile(reader *bufio.Reader, job *lpdJob, control bool, name string, size int64) error {
+	limit := l.maxFileSize(control)
+	var src io.Reader = io.LimitReader(reader, limit+1)
+	if size > 0 {
+		src = io.LimitReader(reader, size)
+	}
+
+	if control {
+		content, err := io.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		if int64(len(content)) > limit {
+			return errLPDFileTooLarge
+		}
+		if size > 0 && int64(len(content)) < size {
+			return io.ErrUnexpectedEOF
+		}
+		job.control = parseLPDControl(content)
+		job.control.name = name
+	} else {
+		path := filepath.Join(job.dir, filepath.Base(name))
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		scanner := newDocumentCounter()
+		n, err := io.Copy(file, io.TeeReader(src, scanner))
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if n > limit {
+			return errLPDFileTooLarge
+		}
+		if size > 0 && n < size {
+			return io.ErrUnexpectedEOF
+		}
+		if _, dup := job.data[name]; !dup {
+			job.order = append(job.order, name)
+		}
+		job.data[name] = path
+		job.scanned[name] = scanner.Jobs()
+	}
+
+	if size > 0 {
+		// Cada arquivo termina com um byte zero
+		if _, err := reader.ReadByte(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// complete informa se o arquivo de controle e todos os arquivos de dados citados nele chegaram.
+func (j *lpdJob) complete() bool {
+	if j.control == nil || len(j.control.prints) == 0 {
+		return false
+	}
+	for _, name := range j.control.prints {
+		if _, ok := j.data[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// finishJob repassa o job (se configurado) e monta o registro dele. Retorna false se o repasse
+// falhou, caso em que nada deve ser registrado.
+func (l *lpdListener) finishJob(job *lpdJob, client string) (PrintData, bool) {
+	var err error
+	switch strings.ToLower(l.cfg.Relay) {
+	case lpdRelayLPD:
+		err = relayLPD(l.cfg.Upstream, l.cfg.UpstreamQueue, job)
+	case lpdRelayRaw:
+		err = relayRaw(l.cfg.Upstream, job)
+	}
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("ERROR: %s could not relay job '%s' from %s to '%s': %v", l.Name(), job.control.jobName, client, l.cfg.Upstream, err))
+		return PrintData{}, false
+	}
+
+	// Páginas somadas dos arquivos de dados distintos; as cópias vêm das linhas de impressão
+	var stream pdlJob
+	copies := make(map[string]int)
+	for _, name := range job.control.prints {
+		copies[name]++
+	}
+	for _, name := range job.order {
+		if copies[name] == 0 {
+			continue // Arquivo recebido mas não citado no controle
+		}
+		stream = sumPDLJobs(append([]pdlJob{stream}, job.scanned[name]...))
+	}
+	if stream.copies < 1 {
+		stream.copies = 1
+	}
+	proto := pdlJob{
+		user:   job.control.user,
+		host:   job.control.host,
+		name:   firstNonEmpty(job.control.jobName, job.control.title, job.control.source),
+		copies: 1,
+	}
+	for _, n := range copies {
+		if n > proto.copies {
+			proto.copies = n
+		}
+	}
+
+	globalLogger.Println(fmt.Sprintf("%s: job '%s' from %s (user '%s', queue '%s'): %d page(s), %d copy(ies).", l.Name(), proto.name, client, proto.user, job.queue, stream.pages, proto.copies))
+	data := jobPrintData(l.cfg, stream, proto, client)
+	if data.Impressora == "" {
+		data.Impressora = job.queue // Sem repasse nem "printer": a fila pedida pelo cliente
+	}
+	return data, true
+}
+
+// parseLPDControl interpreta as linhas do arquivo de controle.
+func parseLPDControl(content []byte) *lpdControl {
+	control := &lpdControl{content: content}
+	for _, raw := range strings.Split(string(content), "\n") {
+		line := strings.TrimRight(raw, "\r")
+		if len(line) < 2 {
+			continue
+		}
+		value := line[1:]
+		switch line[0] {
+		case 'H':
+			control.host = value
+		case 'P':
+			control.user = value
+		case 'J':
+			control.jobName = value
+		case 'T':
+			control.title = value
+		case 'N':
+			control.source = value
+		case 'c', 'd', 'f', 'g', 'l', 'n', 'o', 'p', 'r', 't', 'v':
+			// Comando de impressão: cada linha imprime o arquivo uma vez
+			control.prints = append(control.prints, value)
+		}
+	}
+	return control
+}
+
+// parseLPDFileHeader interpreta "count SP name" dos subcomandos de arquivo.
+func parseLPDFileHeader(operands string) (int64, string, error) {
+	fields := strings.Fields(operands)
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("expected 'count name', got '%s'", operands)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0, "", fmt.Errorf("invalid file size '%s'", fields[0])
+	}
+	return size, fields[1], nil
+}
+
+// readLPDLine lê uma linha de comando terminada em '\n', sem o terminador.
+func readLPDLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) >= lpdMaxLine {
+			return "", fmt.Errorf("LPD command line too long")
+		}
+		line = append(line, b)
+	}
+}
+
+// relayLPD envia o job para outro servidor LPD: primeiro os arquivos de dados, depois o de
+// controle.
+func relayLPD(addr, queue string, job *lpdJob) error {
+	conn, err := net.DialTimeout("tcp", addr, rawDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if queue == "" {
+		queue = job.queue
+	}
+
+	ack := func(step string) error {
+		conn.SetReadDeadline(time.Now().Add(listenerIdleTimeout))
+		var b [1]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return fmt.Errorf("%s: %w", step, err)
+		}
+		if b[0] != 0 {
+			return fmt.Errorf("%s: upstream refused (0x%02x)", step, b[0])
+		}
+		return nil
+	}
+	send := func(sub byte, name string, size int64, body io.Reader) error {
+		if _, err := fmt.Fprintf(conn, "%c%d %s\n", sub, size, name); err != nil {
+			return err
+		}
+		if err := ack("file header " + name); err != nil {
+			return err
+		}
+		if _, err := io.Copy(conn, body); err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte{0}); err != nil {
+			return err
+		}
+		return ack("file " + name)
+	}
+
+	if _, err := fmt.Fprintf(conn, "%c%s\n", lpdCmdReceiveJob, queue); err != nil {
+		return err
+	}
+	if err := ack("queue " + queue); err != nil {
+		return err
+	}
+	for _, name := range job.order {
+		file, err := os.Open(job.data[name])
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err == nil {
+			err = send(lpdSubDataFile, name, info.Size(), file)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	control := job.control.content
+	return send(lpdSubControlFile, job.control.name, int64(len(control)), bytes.NewReader(control))
+}
+
+// relayRaw envia os arquivos de dados para a porta 9100 da impressora, uma vez por linha de
+// impressão do controle (cada linha é uma cópia).
+func relayRaw(addr string, job *lpdJob) error {
+	conn, err := net.DialTimeout("tcp", addr, rawDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, name := range job.control.prints {
+		file, err := os.Open(job.data[name])
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(conn, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		return tcp.CloseWrite()
+	}
+	return nil
+}
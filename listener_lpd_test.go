@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// lpdClient fala o lado cliente do "receive a printer job", conferindo cada confirmação.
+type lpdClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *lpdClient) ack(step string) {
+	c.t.Helper()
+	var b [1]byte
+	if _, err := io.ReadFull(c.conn, b[:]); err != nil {
+		c.t.Fatalf("%s: %v", step, err)
+	}
+	if b[0] != 0 {
+		c.t.Fatalf("%s: got ack 0x%02x, want 0", step, b[0])
+	}
+}
+
+func (c *lpdClient) sendFile(sub byte, name, content string) {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "%c%d %s\n", sub, len(content), name)
+	c.ack("header " + name)
+	c.conn.Write(append([]byte(content), 0))
+	c.ack("file " + name)
+}
+
+func TestLPDReceiveSeveralJobsInOneCommand(t *testing.T) {
+	l := &lpdListener{cfg: &ListenerConfig{Listen: ":515", Printer: "HP"}, spoolDir: t.TempDir()}
+	server, conn := net.Pipe()
+	var jobs []PrintData
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.Serve(server, func(data PrintData) { jobs = append(jobs, data) })
+		server.Close()
+	}()
+
+	client := &lpdClient{t: t, conn: conn}
+	fmt.Fprintf(conn, "%clp\n", lpdCmdReceiveJob)
+	client.ack("queue")
+	client.sendFile(lpdSubControlFile, "cfA001pc", "Hpc-ana\nPana\nJRelatorio\nldfA001pc\n")
+	client.sendFile(lpdSubDataFile, "dfA001pc", "\x1bEPagina 1\fPagina 2\x1bE")
+	// O segundo job manda os dados antes do controle, como o LPR do Windows
+	client.sendFile(lpdSubDataFile, "dfA002pc", "\x1bEPagina 1\fPagina 2\fPagina 3\x1bE")
+	client.sendFile(lpdSubControlFile, "cfA002pc", "Hpc-bia\nPbia\nJPlanilha\nldfA002pc\nldfA002pc\n")
+	conn.Close()
+	<-done
+
+	if len(jobs) != 2 {
+		t.Fatalf("got %d job(s), want 2: %+v", len(jobs), jobs)
+	}
+	want := []struct {
+		user, name    string
+		pages, copies int
+	}{{"ana", "Relatorio", 2, 1}, {"bia", "Planilha", 3, 2}}
+	for i, w := range want {
+		got := jobs[i]
+		if got.Usuario != w.user || got.NomeArquivo != w.name || got.Paginas != w.pages || got.Copias != w.copies {
+			t.Errorf("job %d: got user=%q name=%q pages=%d copies=%d, want %+v", i, got.Usuario, got.NomeArquivo, got.Paginas, got.Copias, w)
+		}
+	}
+}
+
+func TestLPDRejectsOversizedFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		body   string
+	}{
+		{name: "control file declared too large", header: fmt.Sprintf("%c%d cfA001pc\n", lpdSubControlFile, lpdMaxControlFile+1)},
+		{name: "data file declared too large", header: fmt.Sprintf("%c%d dfA001pc\n", lpdSubDataFile, 1<<20+1)},
+		{name: "control file until end of connection", header: fmt.Sprintf("%c0 cfA001pc\n", lpdSubControlFile), body: strings.Repeat("x", lpdMaxControlFile+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &lpdListener{cfg: &ListenerConfig{Listen: ":515", MaxDataFileMB: 1}, spoolDir: t.TempDir()}
+			server, conn := net.Pipe()
+			go func() {
+				l.Serve(server, func(PrintData) { t.Error("oversized job was recorded") })
+				server.Close()
+			}()
+
+			client := &lpdClient{t: t, conn: conn}
+			fmt.Fprintf(conn, "%clp\n", lpdCmdReceiveJob)
+			client.ack("queue")
+			fmt.Fprint(conn, tt.header)
+			if tt.body != "" {
+				client.ack("header")
+				go conn.Write([]byte(tt.body))
+			}
+			var b [1]byte
+			if _, err := io.ReadFull(conn, b[:]); err != nil || b[0] != 1 {
+				t.Errorf("got ack 0x%02x (%v), want 1", b[0], err)
+			}
+			conn.Close()
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// rawDialTimeout limita a espera pela conexão com a impressora.
+const rawDialTimeout = 10 * time.Second
+
+// rawDrainTimeout é quanto o proxy espera a impressora terminar de responder (status PJL)
+// depois que o cliente encerrou o envio.
+const rawDrainTimeout = 5 * time.Second
+
+// rawListener é um proxy da porta 9100: repassa o fluxo do cliente para a impressora real
+// (lc.Upstream) e conta as páginas pelo caminho.
+type rawListener struct {
+	cfg *ListenerConfig
+}
+
+func newRawListener(lc *ListenerConfig) (*rawListener, error) {
+	if lc.Upstream == "" {
+		return nil, fmt.Errorf("upstream printer address is required for '%s' listeners", listenerTypeRaw)
+	}
+	return &rawListener{cfg: lc}, nil
+}
+
+func (l *rawListener) Name() string {
+	if l.cfg.Name != "" {
+		return l.cfg.Name
+	}
+	return "raw " + l.cfg.Listen
+}
+
+// Serve encaminha uma conexão de impressão. Se a impressora não aceitar a conexão, o cliente é
+// desconectado sem receber dados, e o spooler dele tenta de novo; nada é registrado.
+func (l *rawListener) Serve(conn net.Conn, emit func(PrintData)) {
+	client := remoteHost(conn)
+	printer, err := net.DialTimeout("tcp", l.cfg.Upstream, rawDialTimeout)
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("ERROR: %s could not connect to printer '%s' for job from %s: %v", l.Name(), l.cfg.Upstream, client, err))
+		return
+	}
+	defer printer.Close()
+
+	// Canal de volta (status PJL, USTATUS) da impressora para o cliente
+	backChannel := make(chan struct{})
+	go func() {
+		defer close(backChannel)
+		io.Copy(conn, printer)
+	}()
+
+	scanner := newPDLScanner()
+	sent, err := io.Copy(printer, io.TeeReader(conn, scanner))
+	if tcp, ok := printer.(*net.TCPConn); ok {
+		tcp.CloseWrite() // Sinaliza fim do job para a impressora
+	}
+	select {
+	case <-backChannel:
+	case <-time.After(rawDrainTimeout):
+	}
+
+	jobs := scanner.Jobs()
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("ERROR: %s job from %s was interrupted after %d bytes (%d job(s) seen). Not recording it: %v", l.Name(), client, sent, len(jobs), err))
+		return
+	}
+	if len(jobs) == 0 {
+		return // Só comandos PJL (ex: consulta de status do driver)
+	}
+	for _, job := range jobs {
+		globalLogger.Println(fmt.Sprintf("%s: job '%s' from %s (user '%s', %s): %d page(s), %d copy(ies).", l.Name(), job.name, client, job.user, job.language, job.pages, job.copies))
+		emit(jobPrintData(l.cfg, job, pdlJob{}, client))
+	}
+}
@@ -2,17 +2,18 @@ package main
 
 import (
 	"bytes"
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sys/windows/svc"
@@ -27,20 +28,169 @@ var globalLogger *log.Logger // Para logs em arquivo e console (debug mode)
 // Estrutura para o diretório de pendências
 var pendingDir string
 
-// Config - Estrutura para o config.json
-type Config struct {
+// pendingSeq diferencia arquivos de pendência criados no mesmo instante
+var pendingSeq atomic.Uint64
+
+// SourceConfig descreve uma fonte de logs monitorada pelo agente. No config.json, os campos
+// podem vir no nível raiz (uma única fonte, formato original) ou em "sources" (várias fontes).
+type SourceConfig struct {
+	Name      string `json:"name,omitempty"` // Identifica a fonte nos logs do serviço
 	Setor     string `json:"setor"`
 	IDEmpresa int    `json:"idEmpresa"` // CORRIGIDO: Tipo alterado para int
 	// Agora, armazenaremos apenas o diretório base dos logs do PaperCut
 	PapercutLogDir  string `json:"papercutLogDir"`
-	ApiBaseURL      string `json:"apiBaseUrl"` // Novo campo: apenas o endereço base
 	PollingInterval int    `json:"pollingIntervalSeconds"`
+	// SourceType escolhe o formato dos logs: "printlogger" (padrão), "ngmf", "cups" ou "eventxml"
+	SourceType string `json:"sourceType,omitempty"`
+	// FileNameLayout substitui o nome padrão dos arquivos diários (layout Go, ex: "papercut-print-log-2006-01-02.csv");
+	// para "cups", é o nome do arquivo de log (padrão: "page_log")
+	FileNameLayout string `json:"fileNameLayout,omitempty"`
+	// Encoding dos arquivos: "auto" (padrão, detecta pelo BOM/conteúdo), "utf-8", "windows-1252", "utf-16le" ou "utf-16be"
+	Encoding string `json:"encoding,omitempty"`
+	// Delimiter do CSV: "auto" (padrão, testa "," ";" e tab), "tab" ou um caractere
+	Delimiter string `json:"delimiter,omitempty"`
+	// TimeZone em que o PaperCut grava os horários (nome IANA, ex: "America/Manaus"); padrão: fuso do servidor
+	TimeZone string `json:"timeZone,omitempty"`
+	// TimeLayouts substitui os formatos de data/hora aceitos (ex: "dd/MM/yyyy HH:mm:ss" ou "02/01/2006 15:04:05")
+	TimeLayouts []string `json:"timeLayouts,omitempty"`
+	// ColumnMap substitui o nome da coluna do cabeçalho para um campo lógico (ex: {"documentName": "Documento"})
+	ColumnMap map[string]string `json:"columnMap,omitempty"`
+	// PageLogFormat é o PageLogFormat do cupsd.conf usado no page_log (padrão: formato padrão do CUPS)
+	PageLogFormat string `json:"pageLogFormat,omitempty"`
+}
+
+// ListenerConfig descreve um modo de captura em que o agente recebe os jobs pela rede e os
+// repassa para a impressora real, registrando cada job.
+type ListenerConfig struct {
+	Name string `json:"name,omitempty"` // Identifica o listener nos logs do serviço
+	// Type escolhe o protocolo: "raw" (porta 9100), "lpd" (porta 515) ou "ipp" (porta 631)
+	Type string `json:"type"`
+	// Listen é o endereço local de escuta (ex: ":9100" ou "0.0.0.0:9101")
+	Listen string `json:"listen"`
+	// Upstream é o endereço da impressora real (ex: "192.168.0.50:9100"); no tipo "ipp", a URL
+	// da fila de destino (ex: "ipp://192.168.0.50/ipp/print")
+	Upstream string `json:"upstream"`
+	// Queue restringe o LPD a uma fila; vazio aceita qualquer nome de fila
+	Queue string `json:"queue,omitempty"`
+	// Relay escolhe como o LPD repassa os jobs: "" (só registra), "lpd" ou "raw"
+	Relay string `json:"relay,omitempty"`
+	// UpstreamQueue é a fila no servidor LPD de destino; padrão: a fila pedida pelo cliente
+	UpstreamQueue string `json:"upstreamQueue,omitempty"`
+	// MaxDataFileMB limita cada arquivo de dados recebido pelo LPD; padrão: 512
+	MaxDataFileMB int `json:"maxDataFileMB,omitempty"`
+	// Printer é o nome enviado em "impressora"; padrão: o endereço de Upstream
+	Printer   string `json:"printer,omitempty"`
+	Setor     string `json:"setor,omitempty"`
+	IDEmpresa int    `json:"idEmpresa,omitempty"`
+}
+
+// SNMPPrinterConfig descreve uma impressora cujos contadores de páginas são lidos por SNMP,
+// cobrindo o que não passa pelo spooler (cópias no painel, impressão USB direta).
+type SNMPPrinterConfig struct {
+	Name    string `json:"name,omitempty"`    // Nome enviado em "impressora"; padrão: Address
+	Address string `json:"address"`           // IP ou nome da impressora, com porta opcional (padrão 161)
+	Version string `json:"version,omitempty"` // "1", "2c" (padrão) ou "3"
+	// Community é a comunidade do SNMPv1/v2c; padrão "public"
+	Community string `json:"community,omitempty"`
+	// User, AuthProtocol ("MD5", "SHA" ou "SHA256") e PrivProtocol ("DES" ou "AES") configuram o
+	// SNMPv3; protocolos vazios desligam a autenticação ou a cifra
+	User         string `json:"user,omitempty"`
+	AuthProtocol string `json:"authProtocol,omitempty"`
+	AuthPassword string `json:"authPassword,omitempty"`
+	PrivProtocol string `json:"privProtocol,omitempty"`
+	PrivPassword string `json:"privPassword,omitempty"`
+	// ColorOID e MonoOID são os contadores de páginas coloridas e preto e branco, que não fazem
+	// parte da Printer-MIB e variam por fabricante
+	ColorOID     string `json:"colorOid,omitempty"`
+	MonoOID      string `json:"monoOid,omitempty"`
+	PollInterval int    `json:"pollIntervalSeconds,omitempty"` // padrão: 900 (15 minutos)
+	Setor        string `json:"setor,omitempty"`
+	IDEmpresa    int    `json:"idEmpresa,omitempty"`
+}
+
+// AuthConfig define as credenciais do agente nas chamadas à API. Os métodos podem ser
+// combinados (ex: token OAuth2 e assinatura HMAC).
+type AuthConfig struct {
+	// APIKey vai no cabeçalho APIKeyHeader (padrão "X-API-Key") de cada requisição
+	APIKey       string `json:"apiKey,omitempty"`
+	APIKeyHeader string `json:"apiKeyHeader,omitempty"`
+	// TokenURL, ClientID e ClientSecret obtêm um token Bearer pelo fluxo client credentials do
+	// OAuth2; o token é renovado antes de expirar ou quando a API responde 401
+	TokenURL     string `json:"tokenUrl,omitempty"`
+	ClientID     string `json:"clientId,omitempty"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	// HMACSecret assina o corpo de cada requisição com HMAC-SHA256, timestamp e nonce;
+	// HMACKeyID identifica o segredo para a API
+	HMACKeyID  string `json:"hmacKeyId,omitempty"`
+	HMACSecret string `json:"hmacSecret,omitempty"`
+}
+
+// TLSConfig define a proteção TLS das chamadas à API e ao endpoint de token (os SPKI fixados
+// valem só para os servidores da API).
+type TLSConfig struct {
+	CAFile   string `json:"caFile,omitempty"` // Bundle PEM de CAs, somado às raízes do sistema
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"` // Certificado e chave PEM do agente (mTLS)
+	// PinnedSPKI lista hashes SHA-256 (base64, com ou sem "sha256/") de chaves públicas aceitas;
+	// algum certificado da cadeia do servidor precisa ter uma delas
+	PinnedSPKI []string `json:"pinnedSpki,omitempty"`
+	MinVersion string   `json:"minVersion,omitempty"` // "1.2" (padrão) ou "1.3"
+}
+
+// HTTPConfig define o cliente HTTP compartilhado pelas chamadas à API: tempos limite, proxy,
+// conexões mantidas abertas e compressão dos envios.
+type HTTPConfig struct {
+	ConnectTimeout        int `json:"connectTimeoutSeconds,omitempty"`        // Conexão TCP e handshake TLS; padrão 10
+	ResponseHeaderTimeout int `json:"responseHeaderTimeoutSeconds,omitempty"` // Espera pela resposta após o envio; padrão 30
+	Timeout               int `json:"timeoutSeconds,omitempty"`               // Requisição completa; padrão 60
+	// HTTPProxy e HTTPSProxy são usados para URLs http e https, exceto os hosts de NoProxy
+	// (lista separada por vírgulas, como a variável NO_PROXY). Sem nenhum dos dois, valem as
+	// variáveis de ambiente HTTP_PROXY, HTTPS_PROXY e NO_PROXY.
+	HTTPProxy           string `json:"httpProxy,omitempty"`
+	HTTPSProxy          string `json:"httpsProxy,omitempty"`
+	NoProxy             string `json:"noProxy,omitempty"`
+	MaxIdleConnsPerHost int    `json:"maxIdleConnsPerHost,omitempty"`    // padrão 4
+	IdleConnTimeout     int    `json:"idleConnTimeoutSeconds,omitempty"` // padrão 90
+	// Gzip comprime os corpos a partir de 1 KB (Content-Encoding: gzip)
+	Gzip bool `json:"gzip,omitempty"`
+}
+
+// Config - Estrutura para o config.json
+type Config struct {
+	// Fonte única (formato original) e valores padrão herdados pelas entradas de Sources
+	SourceConfig
+	ApiBaseURL string `json:"apiBaseUrl"` // Novo campo: apenas o endereço base
+	// ApiBaseURLs lista as URLs base em ordem de preferência, com failover entre elas; a
+	// primeira substitui ApiBaseURL. ApiHealthPath é o caminho sondado em cada uma (padrão "/")
+	ApiBaseURLs   []string `json:"apiBaseUrls,omitempty"`
+	ApiHealthPath string   `json:"apiHealthPath,omitempty"`
+	// Auth autentica o agente nas chamadas à API
+	Auth AuthConfig `json:"auth,omitempty"`
+	// TLS protege as conexões HTTPS com a API
+	TLS TLSConfig `json:"tls,omitempty"`
+	// HTTP configura o cliente HTTP das chamadas à API
+	HTTP HTTPConfig `json:"http,omitempty"`
+	// Sources lista várias fontes monitoradas pelo mesmo agente, cada uma com offsets próprios
+	Sources []SourceConfig `json:"sources,omitempty"`
+	// Listeners lista os modos de captura pela rede (proxy de impressão)
+	Listeners []ListenerConfig `json:"listeners,omitempty"`
+	// LegacyVerify mantém a consulta a /central/verifyimpression antes de cada envio, para APIs
+	// antigas que ignoram o cabeçalho Idempotency-Key
+	LegacyVerify bool `json:"legacyVerify,omitempty"`
+	// BatchSize agrupa os envios em lotes de até BatchSize registros (0 ou 1 desliga) e
+	// BatchMaxAge limita, em segundos, quanto um lote espera para completar (padrão 5)
+	BatchSize   int `json:"batchSize,omitempty"`
+	BatchMaxAge int `json:"batchMaxAgeSeconds,omitempty"`
+	// SNMPPrinters lista as impressoras cujos contadores são lidos por SNMP
+	SNMPPrinters []SNMPPrinterConfig `json:"snmpPrinters,omitempty"`
 }
 
 // PrintData representa a estrutura do JSON a ser enviado para a API.
 type PrintData struct {
 	Data        string `json:"data"`
 	Hora        string `json:"hora"`
+	Timestamp   string `json:"timestamp,omitempty"` // RFC 3339 com offset (ex: "2026-01-02T15:04:05-03:00")
 	Usuario     string `json:"usuario"`
 	Setor       string `json:"setor"`
 	Paginas     int    `json:"paginas"`
@@ -51,15 +201,16 @@ type PrintData struct {
 	NomePC      string `json:"nomepc"`
 	TipoPage    string `json:"tipopage"`
 	Cor         string `json:"cor"`
+	Duplex      string `json:"duplex,omitempty"` // "DUPLEX" ou "NOT DUPLEX", quando a fonte informa
 	Tamanho     string `json:"tamanho"`
 	IP          string `json:"ip"`
 	MAC         string `json:"mac"`
 	IDEmpresa   int    `json:"empresa"` // CORRIGIDO: Tag JSON para corresponder ao schema do Prisma
+	// JobID identifica o registro de forma estável (arquivo, offset e conteúdo) e também vai no
+	// cabeçalho Idempotency-Key, para que reenvios não dupliquem a impressão
+	JobID string `json:"jobid,omitempty"`
 }
 
-// lastReadOffsets guarda o offset para CADA arquivo de log lido, usando o caminho completo como chave
-var lastReadOffsets = make(map[string]int64)
-
 type myservice struct{}
 
 // Função para configurar o log em arquivo
@@ -107,21 +258,83 @@ func (m *myservice) Execute(args []string, r <-chan svc.ChangeRequest, changes c
 		return false, 1 // Falha ao iniciar se não puder criar o diretório
 	}
 
-	elog.Info(1, fmt.Sprintf("Config loaded: Setor=%s, IDEmpresa=%d, LogDir=%s, ApiBaseUrl=%s",
-		cfg.Setor, cfg.IDEmpresa, cfg.PapercutLogDir, cfg.ApiBaseURL))
-	globalLogger.Println(fmt.Sprintf("Config loaded: Setor=%s, IDEmpresa=%d, LogDir=%s, ApiBaseUrl=%s",
-		cfg.Setor, cfg.IDEmpresa, cfg.PapercutLogDir, cfg.ApiBaseURL))
+	// Carrega os offsets persistidos para retomar a leitura de onde parou
+	if err := setupCheckpointStore(); err != nil {
+		elog.Error(1, fmt.Sprintf("Failed to load checkpoint store: %v", err))
+		globalLogger.Println(fmt.Sprintf("CRITICAL: Failed to load checkpoint store: %v", err))
+		return false, 1
+	}
+
+	// Índice dos jobs já confirmados pela API, consultado antes da verificação remota
+	if err := setupAckIndex(); err != nil {
+		elog.Error(1, fmt.Sprintf("Failed to load acknowledged job index: %v", err))
+		globalLogger.Println(fmt.Sprintf("CRITICAL: Failed to load acknowledged job index: %v", err))
+		return false, 1
+	}
+
+	// Cliente HTTP (TLS) e credenciais usados em todas as chamadas à API
+	if err := setupAPIClient(cfg); err != nil {
+		elog.Error(1, fmt.Sprintf("Failed to set up API client: %v", err))
+		globalLogger.Println(fmt.Sprintf("CRITICAL: Failed to set up API client: %v", err))
+		return false, 1
+	}
+	setupAPIAuth(cfg)
+	setupAPIEndpoints(cfg)
+
+	// Uma fonte com configuração inválida é ignorada para não impedir as demais de rodar
+	sources := newLogSources(cfg)
+	listeners := newJobListeners(cfg)
+	pollers := newSNMPPollers(cfg)
+	if len(sources) == 0 && len(listeners) == 0 && len(pollers) == 0 {
+		elog.Error(1, "No usable log source, listener or SNMP printer configured.")
+		globalLogger.Println("ERROR: No usable log source, listener or SNMP printer configured.")
+		return false, 1
+	}
+
+	// Últimos contadores aceitos pela API, base dos deltas enviados pelo SNMP
+	if len(pollers) > 0 {
+		if err := setupCounterStore(); err != nil {
+			elog.Error(1, fmt.Sprintf("Failed to load SNMP counter store: %v", err))
+			globalLogger.Println(fmt.Sprintf("CRITICAL: Failed to load SNMP counter store: %v", err))
+			return false, 1
+		}
+	}
+
+	for _, source := range sources {
+		elog.Info(1, fmt.Sprintf("Config loaded: Setor=%s, IDEmpresa=%d, Source=%s, LogDir=%s, ApiBaseUrl=%s",
+			source.cfg.Setor, source.cfg.IDEmpresa, source.src.Name(), source.cfg.PapercutLogDir, strings.Join(cfg.ApiBaseURLs, ", ")))
+		globalLogger.Println(fmt.Sprintf("Config loaded: Setor=%s, IDEmpresa=%d, Source=%s, LogDir=%s, ApiBaseUrl=%s",
+			source.cfg.Setor, source.cfg.IDEmpresa, source.src.Name(), source.cfg.PapercutLogDir, strings.Join(cfg.ApiBaseURLs, ", ")))
+	}
 
 	// ** ALTERADO: Processar logs e pendências imediatamente ao iniciar **
 	globalLogger.Println("PrintWatch: Executando tarefa inicial de processamento de pendências...")
 	processPendingImpressions(cfg)
 
-	globalLogger.Println("PrintWatch: Executando tarefa inicial de monitoramento de logs...")
-	err = processPapercutLogs(cfg)
-	if err != nil {
-		// Apenas loga o erro, não impede o serviço de iniciar.
-		globalLogger.Println(fmt.Sprintf("ERROR during initial log processing: %v", err))
-		elog.Warning(1, fmt.Sprintf("Error during initial log processing: %v", err))
+	// Cada fonte roda em sua própria goroutine, com intervalo e offsets independentes:
+	// uma pasta inacessível ou lenta não atrasa as outras.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go runLogSource(cfg, source, stop, &wg)
+	}
+	for _, listener := range listeners {
+		globalLogger.Println(fmt.Sprintf("Listener loaded: Setor=%s, IDEmpresa=%d, Listener=%s, Listen=%s, Upstream=%s",
+			listener.cfg.Setor, listener.cfg.IDEmpresa, listener.l.Name(), listener.cfg.Listen, listener.cfg.Upstream))
+		wg.Add(1)
+		go runJobListener(cfg, listener, stop, &wg)
+	}
+	for _, poller := range pollers {
+		globalLogger.Println(fmt.Sprintf("SNMP printer loaded: Setor=%s, IDEmpresa=%d, Printer=%s, Address=%s, Version=%s",
+			poller.cfg.Setor, poller.cfg.IDEmpresa, poller.name(), poller.cfg.Address, poller.cfg.Version))
+		wg.Add(1)
+		go runSNMPPoller(cfg, poller, stop, &wg)
+	}
+	// Com mais de uma URL da API, as sondas de saúde decidem a volta para a preferida
+	if len(cfg.ApiBaseURLs) > 1 {
+		wg.Add(1)
+		go runEndpointProbes(stop, &wg)
 	}
 
 	pollingInterval := time.Duration(cfg.PollingInterval) * time.Second
@@ -138,12 +351,6 @@ func (m *myservice) Execute(args []string, r <-chan svc.ChangeRequest, changes c
 	for {
 		select {
 		case <-ticker.C:
-			globalLogger.Println("PrintWatch: Executando tarefa de monitoramento de logs...")
-			err := processPapercutLogs(cfg)
-			if err != nil {
-				globalLogger.Println(fmt.Sprintf("ERROR during log processing: %v", err))
-				elog.Warning(1, fmt.Sprintf("Error processing logs: %v", err))
-			}
 			// NOVO: Processar a fila de pendências a cada ciclo
 			globalLogger.Println("PrintWatch: Executando tarefa de processamento de pendências...")
 			processPendingImpressions(cfg)
@@ -154,6 +361,11 @@ func (m *myservice) Execute(args []string, r <-chan svc.ChangeRequest, changes c
 				elog.Info(1, "PrintWatch Service received stop/shutdown command.")
 				globalLogger.Println("PrintWatch Service received stop/shutdown command.")
 				changes <- svc.Status{State: svc.StopPending}
+				close(stop)
+				waitSources(&wg, 10*time.Second)
+				if err := checkpoints.Flush(); err != nil {
+					globalLogger.Println(fmt.Sprintf("ERROR: Failed to persist checkpoints on shutdown: %v", err))
+				}
 				return true, 0
 			case svc.Interrogate:
 				elog.Info(1, "PrintWatch Service received interrogate command.")
@@ -351,8 +563,19 @@ func main() {
 			log.Fatalf("failed to stop %s: %v", serviceName, err)
 		}
 		log.Printf("Service %s stopped\n", serviceName)
+	case "backfill":
+		err = runBackfill(os.Args[2:])
+		if err != nil {
+			log.Fatalf("backfill failed: %v", err)
+		}
+		log.Printf("Backfill finished\n")
+	case "deadletter":
+		err = runDeadLetter(os.Args[2:])
+		if err != nil {
+			log.Fatalf("deadletter failed: %v", err)
+		}
 	default:
-		log.Printf("Running in interactive debug mode. Use 'install', 'remove', 'start', 'stop' to control service.")
+		log.Printf("Running in interactive debug mode. Use 'install', 'remove', 'start', 'stop', 'backfill', 'deadletter' to control service.")
 		runService(serviceName, true)
 	}
 }
@@ -376,77 +599,188 @@ func readConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config.json: %w", err)
 	}
 
-	if config.PapercutLogDir == "" {
-		config.PapercutLogDir = "C:\\Program Files (x86)\\PaperCut Print Logger\\logs\\csv\\daily"
-		globalLogger.Println("WARNING: papercutLogDir not set in config.json, using default: " + config.PapercutLogDir)
+	if len(config.ApiBaseURLs) > 0 {
+		config.ApiBaseURL = config.ApiBaseURLs[0]
 	}
 	if config.ApiBaseURL == "" {
 		config.ApiBaseURL = "http://localhost:3005" // Valor padrão - será substituído pelo config.json
 		globalLogger.Println("WARNING: apiBaseUrl not set in config.json, using default: " + config.ApiBaseURL)
 	}
+	if len(config.ApiBaseURLs) == 0 {
+		config.ApiBaseURLs = []string{config.ApiBaseURL}
+	}
+	for i, baseURL := range config.ApiBaseURLs {
+		if u, err := url.Parse(baseURL); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("apiBaseUrls[%d]: invalid URL '%s'", i, baseURL)
+		}
+		config.ApiBaseURLs[i] = strings.TrimRight(baseURL, "/")
+	}
+	if config.ApiHealthPath == "" {
+		config.ApiHealthPath = "/"
+	}
+	if err := validateAuthConfig(&config.Auth); err != nil {
+		return nil, err
+	}
 	if config.PollingInterval == 0 {
 		config.PollingInterval = 10
 		globalLogger.Println("WARNING: pollingIntervalSeconds not set in config.json, using default: 10 seconds")
 	}
 
+	switch {
+	case len(config.Sources) > 0:
+		for i := range config.Sources {
+			source := &config.Sources[i]
+			if source.PapercutLogDir == "" {
+				return nil, fmt.Errorf("sources[%d]: papercutLogDir is required", i)
+			}
+			inheritSourceDefaults(source, &config.SourceConfig)
+		}
+	case config.PapercutLogDir == "" && (len(config.Listeners) > 0 || len(config.SNMPPrinters) > 0):
+		// Agente só com listeners ou SNMP: nenhuma fonte de log a monitorar
+	default:
+		// Formato original: a própria raiz do config.json é a única fonte
+		if config.PapercutLogDir == "" {
+			config.PapercutLogDir = "C:\\Program Files (x86)\\PaperCut Print Logger\\logs\\csv\\daily"
+			globalLogger.Println("WARNING: papercutLogDir not set in config.json, using default: " + config.PapercutLogDir)
+		}
+		config.Sources = []SourceConfig{config.SourceConfig}
+	}
+
+	for i, source := range config.Sources {
+		for field := range source.ColumnMap {
+			if !isKnownColumn(field) {
+				return nil, fmt.Errorf("sources[%d]: unknown field '%s' in columnMap", i, field)
+			}
+		}
+	}
+
+	for i := range config.Listeners {
+		listener := &config.Listeners[i]
+		if listener.Setor == "" {
+			listener.Setor = config.Setor
+		}
+		if listener.IDEmpresa == 0 {
+			listener.IDEmpresa = config.IDEmpresa
+		}
+	}
+
+	for i := range config.SNMPPrinters {
+		printer := &config.SNMPPrinters[i]
+		if printer.Address == "" {
+			return nil, fmt.Errorf("snmpPrinters[%d]: address is required", i)
+		}
+		if printer.Version == "" {
+			printer.Version = snmpVersion2c
+		}
+		if printer.Setor == "" {
+			printer.Setor = config.Setor
+		}
+		if printer.IDEmpresa == 0 {
+			printer.IDEmpresa = config.IDEmpresa
+		}
+	}
+
 	return &config, nil
 }
 
-// getPapercutLogPath constrói o caminho completo para o arquivo de log do dia atual.
-func getPapercutLogPath(logDir string, t time.Time) string {
-	// Formato: papercut-print-log-YYYY-MM-DD.csv
-	fileName := fmt.Sprintf("papercut-print-log-%s.csv", t.Format("2006-01-02"))
-	return filepath.Join(logDir, fileName)
+// inheritSourceDefaults preenche os campos vazios de source com os valores da raiz do config.json.
+func inheritSourceDefaults(source, defaults *SourceConfig) {
+	if source.Setor == "" {
+		source.Setor = defaults.Setor
+	}
+	if source.IDEmpresa == 0 {
+		source.IDEmpresa = defaults.IDEmpresa
+	}
+	if source.PollingInterval == 0 {
+		source.PollingInterval = defaults.PollingInterval
+	}
+	if source.SourceType == "" {
+		source.SourceType = defaults.SourceType
+	}
+	if source.FileNameLayout == "" {
+		source.FileNameLayout = defaults.FileNameLayout
+	}
+	if source.Encoding == "" {
+		source.Encoding = defaults.Encoding
+	}
+	if source.Delimiter == "" {
+		source.Delimiter = defaults.Delimiter
+	}
+	if source.TimeZone == "" {
+		source.TimeZone = defaults.TimeZone
+	}
+	if len(source.TimeLayouts) == 0 {
+		source.TimeLayouts = defaults.TimeLayouts
+	}
+	if len(source.ColumnMap) == 0 {
+		source.ColumnMap = defaults.ColumnMap
+	}
+	if source.PageLogFormat == "" {
+		source.PageLogFormat = defaults.PageLogFormat
+	}
 }
 
-// NOVO: tryProcessImpression tenta enviar uma impressão e retorna true em sucesso, false em falha recuperável
-func tryProcessImpression(cfg *Config, data PrintData, sourceFile string) bool {
-	verifyURL := cfg.ApiBaseURL + "/central/verifyimpression"
-	exists, err := verifyImpressionExists(verifyURL, data)
-	if err != nil {
-		globalLogger.Println(fmt.Sprintf("API_COMM_FAIL (Verify) for user %s from source '%s'. Error: %v", data.Usuario, sourceFile, err))
-		return false
+// NOVO: tryProcessImpression tenta enviar uma impressão e classifica o resultado: sucesso,
+// duplicata, falha transitória (tentar de novo) ou permanente (dead-letter)
+func tryProcessImpression(cfg *Config, data PrintData, sourceFile string) deliveryResult {
+	// O índice local responde pelos jobs já confirmados sem ir até a API
+	if acked.Contains(data) {
+		globalLogger.Println(fmt.Sprintf("Impression for user %s from source '%s' already acknowledged (local index). Skipping.", data.Usuario, sourceFile))
+		return deliveryResult{outcome: outcomeDuplicate}
 	}
 
-	if exists {
-		globalLogger.Println(fmt.Sprintf("Impression for user %s from source '%s' already exists. Skipping.", data.Usuario, sourceFile))
-		return true
+	// Com JobID, o envio é idempotente e dispensa a verificação. Registros sem JobID (fila de
+	// pendências de versões anteriores) e APIs antigas continuam verificando antes.
+	if data.JobID == "" || cfg.LegacyVerify {
+		verifyURL := apiEndpoints.Current() + "/central/verifyimpression"
+		exists, err := verifyImpressionExists(verifyURL, data)
+		if err != nil {
+			globalLogger.Println(fmt.Sprintf("API_COMM_FAIL (Verify) for user %s from source '%s'. Error: %v", data.Usuario, sourceFile, err))
+			return failedDelivery(err)
+		}
+
+		if exists {
+			globalLogger.Println(fmt.Sprintf("Impression for user %s from source '%s' already exists. Skipping.", data.Usuario, sourceFile))
+			acked.Add(data)
+			return deliveryResult{outcome: outcomeDuplicate}
+		}
 	}
 
-	sendURL := cfg.ApiBaseURL + "/central/receptprintreq"
-	err = sendDataToAPI(sendURL, data)
+	baseURL := apiEndpoints.Current()
+	err := sendDataToAPI(baseURL+"/central/receptprintreq", data, data.JobID)
 	if err != nil {
 		globalLogger.Println(fmt.Sprintf("API_COMM_FAIL (Send) for user %s from source '%s'. Error: %v", data.Usuario, sourceFile, err))
-		return false
+		return failedDelivery(err)
 	}
 
-	globalLogger.Println(fmt.Sprintf("Successfully sent print data for user %s from source '%s'.", data.Usuario, sourceFile))
-	return true
+	globalLogger.Println(fmt.Sprintf("Successfully sent print data for user %s from source '%s' to %s.", data.Usuario, sourceFile, baseURL))
+	acked.Add(data)
+	return deliveryResult{outcome: outcomeSuccess}
 }
 
-// NOVO: setupPendingDir inicializa o diretório para armazenar impressões pendentes.
+// NOVO: setupPendingDir inicializa o diretório para armazenar impressões pendentes e, ao lado
+// dele, o dead-letter dos registros recusados.
 func setupPendingDir() error {
 	logDir := filepath.Join(os.Getenv("PROGRAMDATA"), "PrintWatchServiceLogs")
 	pendingDir = filepath.Join(logDir, "pending")
 	if err := os.MkdirAll(pendingDir, 0755); err != nil {
 		return fmt.Errorf("failed to create pending directory '%s': %w", pendingDir, err)
 	}
+	deadLetterDir = filepath.Join(logDir, "dead-letter")
+	if err := os.MkdirAll(deadLetterDir, 0755); err != nil {
+		return fmt.Errorf("failed to create dead-letter directory '%s': %w", deadLetterDir, err)
+	}
 	globalLogger.Println("Pending impressions directory initialized at:", pendingDir)
 	return nil
 }
 
 // NOVO: savePendingImpression salva uma impressão falha na fila local.
 func savePendingImpression(data PrintData) error {
-	fileName := fmt.Sprintf("%d.json", time.Now().UnixNano())
-	filePath := filepath.Join(pendingDir, fileName)
-
-	jsonData, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal pending impression data: %w", err)
-	}
-
-	if err := os.WriteFile(filePath, jsonData, 0644); err != nil {
-		return fmt.Errorf("failed to write pending impression to file '%s': %w", filePath, err)
+	filePath := filepath.Join(pendingDir, queueFileName())
+	now := time.Now()
+	entry := pendingImpression{Impression: data, Attempts: 1, FirstFailure: now, NextAttempt: now.Add(retryBackoff(1))}
+	if err := writePendingImpression(filePath, entry); err != nil {
+		return err
 	}
 
 	globalLogger.Println(fmt.Sprintf("Saved impression for user %s to pending queue: %s", data.Usuario, filePath))
@@ -468,169 +802,72 @@ func processPendingImpressions(cfg *Config) {
 
 	globalLogger.Println(fmt.Sprintf("Found %d pending impression(s) to process.", len(files)))
 
-	for _, file := range files {
-		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
-			continue
-		}
-
-		filePath := filepath.Join(pendingDir, file.Name())
-		fileData, err := os.ReadFile(filePath)
-		if err != nil {
-			globalLogger.Println(fmt.Sprintf("ERROR: Failed to read pending file '%s': %v", filePath, err))
-			continue
+	// Em lotes, os arquivos são agrupados e cada um é tratado conforme o resultado do seu registro
+	var batchPaths []string
+	var batchEntries []pendingImpression
+	flushBatch := func() {
+		if len(batchEntries) == 0 {
+			return
 		}
-
-		var printData PrintData
-		if err := json.Unmarshal(fileData, &printData); err != nil {
-			globalLogger.Println(fmt.Sprintf("ERROR: Failed to unmarshal pending file '%s'. Deleting corrupt file. Error: %v", filePath, err))
-			os.Remove(filePath) // Remove arquivo corrompido para não bloquear a fila
-			continue
+		items := make([]PrintData, len(batchEntries))
+		for i, entry := range batchEntries {
+			items[i] = entry.Impression
 		}
-
-		// Tenta processar a impressão da fila
-		success := tryProcessImpression(cfg, printData, filePath)
-		if success {
-			// Se foi sucesso (enviado ou já existe), remove da fila
-			globalLogger.Println(fmt.Sprintf("Successfully processed pending impression '%s'. Removing from queue.", filePath))
-			if err := os.Remove(filePath); err != nil {
-				globalLogger.Println(fmt.Sprintf("ERROR: Failed to remove processed pending file '%s': %v", filePath, err))
-			}
-		} else {
-			// Se falhou, deixa na fila para a próxima tentativa
-			globalLogger.Println(fmt.Sprintf("Failed to process pending impression '%s'. Will retry later.", filePath))
+		results := sendImpressionBatch(cfg, items, pendingDir)
+		for i, filePath := range batchPaths {
+			settlePendingFile(filePath, batchEntries[i], results[i])
 		}
+		batchPaths, batchEntries = nil, nil
 	}
-}
+	defer flushBatch()
 
-// processPapercutLogs lê novas linhas do log e as envia para a API.
-func processPapercutLogs(cfg *Config) error {
-	// Obtém o caminho do log para o dia atual
-	papercutLogPath := getPapercutLogPath(cfg.PapercutLogDir, time.Now())
-
-	file, err := os.OpenFile(papercutLogPath, os.O_RDONLY, 0644)
-	if err != nil {
-		// Se o arquivo do dia ainda não existe, não é um erro fatal, apenas ignora por enquanto.
-		if os.IsNotExist(err) {
-			globalLogger.Println(fmt.Sprintf("INFO: PaperCut log file for today (%s) does not exist yet. Skipping this cycle.", papercutLogPath))
-			return nil
+	waiting := 0
+	defer func() {
+		if waiting > 0 {
+			globalLogger.Println(fmt.Sprintf("%d pending impression(s) are waiting for their next retry time.", waiting))
 		}
-		return fmt.Errorf("failed to open PaperCut log file '%s': %w", papercutLogPath, err)
-	}
-	defer file.Close()
+	}()
 
-	// Obtém o offset para o arquivo de log atual
-	currentOffset, found := lastReadOffsets[papercutLogPath]
-	if !found {
-		// Se for a primeira vez que vemos este arquivo, o offset é 0
-		currentOffset = 0
-		globalLogger.Println(fmt.Sprintf("INFO: Starting to read new log file: %s from offset 0", papercutLogPath))
-	}
-
-	_, err = file.Seek(currentOffset, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("failed to seek to last offset %d in log file '%s': %w", currentOffset, papercutLogPath, err)
-	}
-
-	reader := csv.NewReader(file)
-	reader.Comma = ','
-	reader.LazyQuotes = true
-	reader.FieldsPerRecord = -1 // **NOVO:** Permite um número variável de campos por linha
-
-	// Se o offset for 0 (novo arquivo ou primeira leitura), lê o cabeçalho.
-	if currentOffset == 0 {
-		_, err = reader.Read() // Ignora a linha do cabeçalho
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("failed to read CSV header from '%s': %w", papercutLogPath, err)
-		}
-	}
-
-	// Processar linhas uma por uma
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break // Fim do arquivo
-		}
-		if err != nil {
-			globalLogger.Println(fmt.Sprintf("WARNING: Failed to read CSV record from '%s', skipping: %v", papercutLogPath, err))
+	for i, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
 			continue
 		}
-
-		// Garante que o registro tenha colunas suficientes para os dados que você precisa
-		// Com base no novo cabeçalho: Time,User,Pages,Copies,Printer,Document Name,Client,Paper Size,Language,Height,Width,Duplex,Grayscale,Size
-		if len(record) < 14 {
-			globalLogger.Println(fmt.Sprintf("WARNING: Skipping malformed record (not enough columns) from '%s': %v", papercutLogPath, record))
-			continue
+		// Com a API fora, não adianta percorrer a fila: o restante espera a próxima sonda
+		if apiBreaker.IsOpen() {
+			globalLogger.Println(fmt.Sprintf("API circuit breaker is open. Leaving %d pending impression(s) for a later cycle.", len(files)-i))
+			break
 		}
 
-		// --- Montar a estrutura de dados para a API com os novos campos ---
-		// Tenta analisar o timestamp. Formato novo: "2006-01-02 15:04:05"
-		parsedTime, err := time.Parse("2006-01-02 15:04:05", strings.TrimSpace(record[0]))
-		if err != nil {
-			globalLogger.Println(fmt.Sprintf("WARNING: Could not parse timestamp '%s', skipping record: %v", record[0], err))
+		filePath := filepath.Join(pendingDir, file.Name())
+		entry, err := readPendingImpression(filePath)
+		if os.IsNotExist(err) {
 			continue
 		}
-
-		paginas, err := strconv.Atoi(strings.TrimSpace(record[2])) // Coluna "Pages"
 		if err != nil {
-			globalLogger.Println(fmt.Sprintf("WARNING: Could not parse pages '%s' to int, using 0: %v", record[2], err))
-			paginas = 0 // Define 0 se a conversão falhar
+			globalLogger.Println(fmt.Sprintf("ERROR: Failed to read pending file '%s'. Deleting corrupt file. Error: %v", filePath, err))
+			os.Remove(filePath) // Remove arquivo corrompido para não bloquear a fila
+			continue
 		}
-
-		copias, err := strconv.Atoi(strings.TrimSpace(record[3])) // Coluna "Copies"
-		if err != nil {
-			globalLogger.Println(fmt.Sprintf("WARNING: Could not parse copies '%s' to int, using 1: %v", record[3], err))
-			copias = 1 // Define 1 se a conversão falhar
+		// Cada registro espera o próprio backoff: um que sempre falha não chama a API a cada
+		// ciclo nem reabre o circuito para os demais
+		if time.Now().Before(entry.NextAttempt) {
+			waiting++
+			continue
 		}
 
-		// NOVO: O campo "tipo" agora é a extensão do arquivo
-		documentName := strings.TrimSpace(record[5])
-		fileExtension := strings.TrimPrefix(filepath.Ext(documentName), ".")
-
-		// --- Capturar informações de rede ---
-		ip, mac, err := getNetworkInfo()
-		if err != nil {
-			globalLogger.Println(fmt.Sprintf("WARNING: Could not get network info: %v. IP and MAC will be empty.", err))
-		}
-
-		printData := PrintData{
-			Data:        parsedTime.Format("2006-01-02"),
-			Hora:        parsedTime.Format("15:04:05"),
-			Usuario:     strings.TrimSpace(record[1]), // "User"
-			Setor:       cfg.Setor,
-			Paginas:     paginas,
-			Copias:      copias,
-			Impressora:  strings.TrimSpace(record[4]),  // "Printer"
-			NomeArquivo: documentName,                  // "Document Name"
-			Tipo:        fileExtension,                 // Extensão do arquivo (ex: "pdf")
-			NomePC:      strings.TrimSpace(record[6]),  // "Client"
-			TipoPage:    strings.TrimSpace(record[7]),  // "Paper Size"
-			Cor:         strings.TrimSpace(record[12]), // CORRIGIDO: Usa o valor original de Grayscale (ex: "GRAYSCALE")
-			Tamanho:     strings.TrimSpace(record[13]), // "Size"
-			IP:          ip,                            // Capturado localmente
-			MAC:         mac,                           // Capturado localmente
-			IDEmpresa:   cfg.IDEmpresa,                 // NOVO: Adicionado do config
-		}
-
-		// ** ALTERADO: Tentar processar e, se falhar, colocar na fila **
-		success := tryProcessImpression(cfg, printData, papercutLogPath)
-		if !success {
-			// A falha já foi logada dentro de tryProcessImpression. Agora, apenas enfileiramos.
-			if err := savePendingImpression(printData); err != nil {
-				// Este é um erro crítico, pois a fila não está funcionando.
-				globalLogger.Println(fmt.Sprintf("CRITICAL_ERROR: FAILED TO SAVE PENDING IMPRESSION for user %s. Data may be lost. Error: %v", printData.Usuario, err))
+		if batchEnabled(cfg) {
+			batchPaths = append(batchPaths, filePath)
+			batchEntries = append(batchEntries, entry)
+			if len(batchEntries) >= cfg.BatchSize {
+				flushBatch()
 			}
+			continue
 		}
-	}
 
-	// Atualizar o lastReadOffset para a posição atual do arquivo APENAS para o arquivo atual
-	currentFileOffset, err := file.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return fmt.Errorf("failed to get current file offset for '%s': %w", papercutLogPath, err)
+		// Tenta processar a impressão da fila: entregue sai da fila, recusada vai para o
+		// dead-letter e falha transitória fica para a próxima tentativa
+		settlePendingFile(filePath, entry, tryProcessImpression(cfg, entry.Impression, filePath))
 	}
-	lastReadOffsets[papercutLogPath] = currentFileOffset
-	globalLogger.Println(fmt.Sprintf("Updated lastReadOffset for '%s' to: %d", papercutLogPath, currentFileOffset))
-
-	return nil
 }
 
 // verifyImpressionExists verifica se uma impressão já existe na API enviando os dados completos.
@@ -642,16 +879,15 @@ func verifyImpressionExists(verifyApiEndpoint string, data PrintData) (bool, err
 
 	globalLogger.Println(fmt.Sprintf("Verifying impression existence at %s", verifyApiEndpoint))
 
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Post(verifyApiEndpoint, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := postToAPI(verifyApiEndpoint, jsonData, "")
 	if err != nil {
-		return false, fmt.Errorf("failed to make HTTP POST request to verification endpoint %s: %w", verifyApiEndpoint, err)
+		return false, err
 	}
-	defer resp.Body.Close()
+	defer closeResponse(resp)
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return false, fmt.Errorf("verification API %s returned non-200 status: %d - %s", verifyApiEndpoint, resp.StatusCode, strings.TrimSpace(string(bodyBytes)))
+		return false, &apiStatusError{Endpoint: verifyApiEndpoint, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(bodyBytes))}
 	}
 
 	bodyBytes, err := io.ReadAll(resp.Body)
@@ -682,8 +918,10 @@ func verifyImpressionExists(verifyApiEndpoint string, data PrintData) (bool, err
 	return false, nil
 }
 
-// sendDataToAPI envia um payload JSON via HTTP POST.
-func sendDataToAPI(apiEndpoint string, data interface{}) error {
+// sendDataToAPI envia um payload JSON via HTTP POST. Com idempotencyKey, o envio pode ser
+// repetido com segurança: a API responde 409 Conflict para uma chave já registrada, o que
+// também conta como sucesso.
+func sendDataToAPI(apiEndpoint string, data interface{}, idempotencyKey string) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return fmt.Errorf("failed to marshal JSON data: %w", err)
@@ -691,21 +929,85 @@ func sendDataToAPI(apiEndpoint string, data interface{}) error {
 
 	globalLogger.Println(fmt.Sprintf("Sending data to API %s: %s", apiEndpoint, string(jsonData)))
 
-	resp, err := http.Post(apiEndpoint, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := postToAPI(apiEndpoint, jsonData, idempotencyKey)
 	if err != nil {
-		return fmt.Errorf("failed to make HTTP POST request to %s: %w", apiEndpoint, err)
+		return err
 	}
-	defer resp.Body.Close()
+	defer closeResponse(resp)
 
+	if resp.StatusCode == http.StatusConflict && idempotencyKey != "" {
+		globalLogger.Println(fmt.Sprintf("API %s already has Idempotency-Key %s. Treating as delivered.", apiEndpoint, idempotencyKey))
+		return nil
+	}
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API %s returned non-200/201 status: %d - %s", apiEndpoint, resp.StatusCode, strings.TrimSpace(string(bodyBytes)))
+		return &apiStatusError{Endpoint: apiEndpoint, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(bodyBytes))}
 	}
 
 	globalLogger.Println(fmt.Sprintf("API response status for %s: %s", apiEndpoint, resp.Status))
 	return nil
 }
 
+// postToAPI faz o POST de um corpo JSON para a API pelo cliente compartilhado, com as
+// credenciais configuradas e passando pelo circuit breaker. Com idempotencyKey, o cabeçalho
+// Idempotency-Key é incluído. Com http.gzip, corpos a partir de gzipMinSize vão comprimidos; se
+// a API não aceitar (415), a compressão é desligada e o envio é repetido sem ela.
+func postToAPI(apiEndpoint string, body []byte, idempotencyKey string) (*http.Response, error) {
+	compress := apiGzip.Load() && len(body) >= gzipMinSize
+	resp, err := doPostToAPI(apiEndpoint, body, idempotencyKey, compress)
+	if err == nil && compress && resp.StatusCode == http.StatusUnsupportedMediaType {
+		closeResponse(resp)
+		apiGzip.Store(false)
+		globalLogger.Println(fmt.Sprintf("WARNING: API %s does not accept gzip request bodies (415). Sending uncompressed from now on.", apiEndpoint))
+		return doPostToAPI(apiEndpoint, body, idempotencyKey, false)
+	}
+	return resp, err
+}
+
+func doPostToAPI(apiEndpoint string, body []byte, idempotencyKey string, compress bool) (*http.Response, error) {
+	payload := body
+	if compress {
+		compressed, err := gzipBody(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress request body: %w", err)
+		}
+		payload = compressed
+	}
+	req, err := http.NewRequest(http.MethodPost, apiEndpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build HTTP POST request to %s: %w", apiEndpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	// O breaker vem antes das credenciais: com o circuito aberto, nem o token é pedido. Uma
+	// falha ao obter o token conta como falha da chamada, para que o servidor de token fora do
+	// ar também abra o circuito e a sonda liberada não fique sem resultado. A assinatura HMAC
+	// cobre o JSON antes da compressão.
+	if err := apiBreaker.Allow(); err != nil {
+		return nil, err
+	}
+	if err := apiAuth.Authorize(req, body); err != nil {
+		apiBreaker.Record(true)
+		return nil, err
+	}
+	resp, err := apiClient.Do(req)
+	failed := apiCallFailed(resp, err)
+	apiBreaker.Record(failed)
+	apiEndpoints.Record(apiEndpoint, failed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make HTTP POST request to %s: %w", apiEndpoint, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		apiAuth.Rejected()
+	}
+	return resp, nil
+}
+
 // getNetworkInfo encontra o primeiro endereço IPv4 e MAC de uma interface de rede ativa.
 func getNetworkInfo() (string, string, error) {
 	interfaces, err := net.Interfaces()
@@ -0,0 +1,874 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pdlMaxLine limita o tamanho de uma linha de texto (PJL/PostScript) guardada para análise;
+// o restante de linhas maiores (ex: imagens em hexadecimal) é ignorado.
+const pdlMaxLine = 4096
+
+// Linguagens reconhecidas no fluxo de impressão.
+const (
+	pdlPJL        = "PJL"
+	pdlPostScript = "POSTSCRIPT"
+	pdlPCL        = "PCL"
+	pdlPCLXL      = "PCLXL"
+	pdlOther      = "OTHER"
+)
+
+// pdlJob é o que foi extraído de um job: cabeçalhos PJL e marcadores de página.
+type pdlJob struct {
+	user     string
+	host     string
+	name     string
+	paper    string
+	color    string // "GRAYSCALE" ou "NOT GRAYSCALE", como no Print Logger
+	duplex   string // "DUPLEX" ou "NOT DUPLEX", como no Print Logger
+	copies   int
+	pages    int
+	language string // Última linguagem de impressão usada no job
+	bytes    int64
+}
+
+// pdlScanner analisa o fluxo de um job (PJL com PCL5, PCL XL ou PostScript) à medida que ele é
+// encaminhado para a impressora. Implementa io.Writer para ser usado com io.TeeReader; nada é
+// bufferizado além da linha de texto atual.
+type pdlScanner struct {
+	mode         string
+	job          pdlJob
+	done         []pdlJob
+	line         []byte
+	lineOverflow bool
+	pcl          pclState
+	xl           xlState
+}
+
+func newPDLScanner() *pdlScanner {
+	return &pdlScanner{mode: pdlPJL}
+}
+
+// Write analisa p. Nunca retorna erro, para não interromper o encaminhamento do job.
+func (s *pdlScanner) Write(p []byte) (int, error) {
+	s.job.bytes += int64(len(p))
+	for _, b := range p {
+		s.feed(b)
+	}
+	return len(p), nil
+}
+
+// Jobs encerra a análise e retorna os jobs encontrados no fluxo.
+func (s *pdlScanner) Jobs() []pdlJob {
+	if len(s.line) > 0 && (s.mode == pdlPJL || s.mode == pdlPostScript) {
+		s.endLine()
+	}
+	if s.mode == pdlPCL {
+		s.endPCLPage()
+	}
+	s.finishJob()
+	return s.done
+}
+
+func (s *pdlScanner) feed(b byte) {
+	switch s.mode {
+	case pdlPCL:
+		s.feedPCL(b)
+	case pdlPCLXL:
+		s.feedXL(b)
+	case pdlOther:
+		// Linguagem desconhecida (ex: PDF direto): só o UEL devolve o fluxo ao PJL
+		s.feedOther(b)
+	default:
+		s.feedText(b)
+	}
+}
+
+// switchMode muda a linguagem em análise, registrando-a no job.
+func (s *pdlScanner) switchMode(mode string) {
+	s.mode = mode
+	s.line = s.line[:0]
+	s.lineOverflow = false
+	s.pcl = pclState{}
+	s.xl = xlState{}
+	if mode != pdlPJL {
+		s.job.language = mode
+	}
+}
+
+// finishJob encerra o job atual. Fluxos só com comandos PJL (ex: consultas de status) não
+// são jobs de impressão e são descartados.
+func (s *pdlScanner) finishJob() {
+	if s.job.language != "" {
+		if s.job.pages == 0 {
+			s.job.pages = 1 // Houve dados de impressão sem marcador de página reconhecível
+		}
+		if s.job.copies < 1 {
+			s.job.copies = 1
+		}
+		s.done = append(s.done, s.job)
+	}
+	s.job = pdlJob{}
+}
+
+// --- PJL e PostScript (linhas de texto) ---
+
+func (s *pdlScanner) feedText(b byte) {
+	if b == '\n' || b == '\r' {
+		s.endLine()
+		return
+	}
+	if s.mode == pdlPJL && !s.lineOverflow {
+		// Dados sem "@PJL ENTER LANGUAGE": identifica a linguagem pelo primeiro byte da linha
+		switch {
+		case len(s.line) == 0 && b == '%':
+			s.switchMode(pdlPostScript)
+		case len(s.line) == 0 && b == ')' || len(s.line) == 0 && b == '(':
+			s.switchMode(pdlPCLXL)
+			s.feedXL(b)
+			return
+		case len(s.line) == 0 && b != '@' && b != 0x1b && b != ' ' && b != '\t' && b != '\f' && b != 0x04:
+			s.switchMode(pdlPCL)
+			s.feedPCL(b)
+			return
+		case len(s.line) == 1 && s.line[0] == 0x1b && b != '%':
+			s.switchMode(pdlPCL)
+			s.feedPCL(0x1b)
+			s.feedPCL(b)
+			return
+		}
+	}
+	if len(s.line) >= pdlMaxLine {
+		s.lineOverflow = true
+		return
+	}
+	s.line = append(s.line, b)
+	if s.mode == pdlPJL && bytes.Equal(s.line, uel) {
+		s.line = s.line[:0] // O que vem após o UEL é tratado como início de linha
+	}
+}
+
+// uel é o Universal Exit Language, que encerra a linguagem atual e volta ao PJL.
+var uel = []byte("\x1b%-12345X")
+
+func (s *pdlScanner) endLine() {
+	line := s.line
+	s.line = s.line[:0]
+	s.lineOverflow = false
+
+	if i := bytes.Index(line, uel); i >= 0 {
+		if s.mode == pdlPostScript && i > 0 {
+			s.postScriptLine(string(line[:i]))
+		}
+		s.mode = pdlPJL
+		line = line[i+len(uel):]
+	}
+	text := strings.TrimSpace(strings.Trim(string(line), "\x04\x00"))
+	if text == "" {
+		return
+	}
+	if s.mode == pdlPostScript {
+		s.postScriptLine(text)
+		return
+	}
+	s.pjlLine(text)
+}
+
+// pjlLine interpreta um comando PJL (ex: @PJL SET USERNAME="joao").
+func (s *pdlScanner) pjlLine(line string) {
+	if len(line) < 4 || !strings.EqualFold(line[:4], "@PJL") {
+		return
+	}
+	command := strings.TrimSpace(line[4:])
+	upper := strings.ToUpper(command)
+
+	switch {
+	case strings.HasPrefix(upper, "ENTER"):
+		switch language := strings.ToUpper(pjlValue(command)); language {
+		case "POSTSCRIPT":
+			s.switchMode(pdlPostScript)
+		case "PCLXL":
+			s.switchMode(pdlPCLXL)
+		case "PCL":
+			s.switchMode(pdlPCL)
+		default:
+			s.switchMode(pdlOther)
+		}
+	case strings.HasPrefix(upper, "JOB"):
+		// Um novo JOB depois de páginas já impressas indica vários jobs na mesma conexão
+		if s.job.language != "" {
+			s.finishJob()
+		}
+		if name := pjlNamedValue(command, "NAME"); name != "" {
+			s.job.name = name
+		}
+	case strings.HasPrefix(upper, "EOJ"):
+		s.finishJob()
+	case strings.HasPrefix(upper, "SET"):
+		s.pjlSet(strings.TrimSpace(command[3:]))
+	case strings.HasPrefix(upper, "COMMENT"):
+		// HP Universal: @PJL COMMENT "Username: joao; App Filename: Documento; ..."
+		for _, part := range strings.Split(strings.Trim(strings.TrimSpace(command[7:]), `"`), ";") {
+			key, value, ok := strings.Cut(part, ":")
+			if !ok {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "username":
+				if s.job.user == "" {
+					s.job.user = value
+				}
+			case "app filename":
+				if s.job.name == "" {
+					s.job.name = value
+				}
+			}
+		}
+	}
+}
+
+// pjlSet trata "@PJL SET VARIAVEL=valor".
+func (s *pdlScanner) pjlSet(assignment string) {
+	key, _, _ := strings.Cut(assignment, "=")
+	value := pjlValue(assignment)
+	switch strings.ToUpper(strings.TrimSpace(key)) {
+	case "USERNAME", "USER":
+		s.job.user = value
+	case "JOBNAME":
+		s.job.name = value
+	case "QTY", "COPIES":
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			s.job.copies = n
+		}
+	case "PAPER":
+		s.job.paper = value
+	case "DUPLEX":
+		if strings.EqualFold(value, "ON") {
+			s.job.duplex = "DUPLEX"
+		} else if strings.EqualFold(value, "OFF") {
+			s.job.duplex = "NOT DUPLEX"
+		}
+	case "RENDERMODE":
+		if strings.EqualFold(value, "GRAYSCALE") {
+			s.job.color = "GRAYSCALE"
+		} else if strings.EqualFold(value, "COLOR") {
+			s.job.color = "NOT GRAYSCALE"
+		}
+	case "JOBATTR":
+		// Drivers Ricoh, Kyocera e outros: @PJL SET JOBATTR="@JOAU=joao"
+		if attr, v, ok := strings.Cut(value, "="); ok {
+			switch strings.ToUpper(attr) {
+			case "@JOAU":
+				s.job.user = v
+			case "@JOHO", "@CLHO":
+				s.job.host = v
+			case "@JONA":
+				s.job.name = v
+			}
+		}
+	}
+}
+
+// pjlValue retorna o valor após o '=' de um comando PJL, sem aspas.
+func pjlValue(command string) string {
+	_, value, ok := strings.Cut(command, "=")
+	if !ok {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(value), `"`)
+}
+
+// pjlNamedValue retorna o valor de uma opção (ex: NAME="x") de um comando PJL.
+func pjlNamedValue(command, option string) string {
+	i := strings.Index(strings.ToUpper(command), option)
+	if i < 0 {
+		return ""
+	}
+	rest := strings.TrimSpace(command[i+len(option):])
+	if !strings.HasPrefix(rest, "=") {
+		return ""
+	}
+	rest = strings.TrimSpace(rest[1:])
+	if strings.HasPrefix(rest, `"`) {
+		if end := strings.IndexByte(rest[1:], '"'); end >= 0 {
+			return rest[1 : end+1]
+		}
+		return rest[1:]
+	}
+	value, _, _ := strings.Cut(rest, " ")
+	return value
+}
+
+// postScriptLine interpreta os comentários DSC e os operadores de cópias do PostScript.
+func (s *pdlScanner) postScriptLine(line string) {
+	switch {
+	case strings.HasPrefix(line, "%%Page:"):
+		s.job.pages++
+	case strings.HasPrefix(line, "%%For:"):
+		if s.job.user == "" {
+			s.job.user = strings.Trim(strings.TrimSpace(line[6:]), "()")
+		}
+	case strings.HasPrefix(line, "%%Title:"):
+		if s.job.name == "" {
+			s.job.name = strings.Trim(strings.TrimSpace(line[8:]), "()")
+		}
+	case strings.Contains(line, "/#copies"):
+		s.setPostScriptCopies(line, "/#copies")
+	case strings.Contains(line, "/NumCopies"):
+		s.setPostScriptCopies(line, "/NumCopies")
+	}
+}
+
+// setPostScriptCopies lê o número após key (ex: "/#copies 2 def").
+func (s *pdlScanner) setPostScriptCopies(line, key string) {
+	fields := strings.Fields(line[strings.Index(line, key)+len(key):])
+	if len(fields) > 0 {
+		if n, err := strconv.Atoi(fields[0]); err == nil && n > 0 {
+			s.job.copies = n
+		}
+	}
+}
+
+// --- PCL5 ---
+
+// pclState acompanha as sequências de escape do PCL5, para não confundir dados binários
+// (rasters, fontes) com o form feed que ejeta a página.
+type pclState struct {
+	phase      int // pclText, pclEscape, pclGroup, pclValue, pclSkip
+	paramChar  byte
+	groupChar  byte
+	value      []byte
+	skip       int64
+	sawContent bool // Houve conteúdo desde o último form feed
+	marked     bool // Houve texto ou dados gráficos desde o último form feed
+}
+
+const (
+	pclText = iota
+	pclEscape
+	pclGroup
+	pclValue
+	pclSkip
+)
+
+func (s *pdlScanner) feedPCL(b byte) {
+	p := &s.pcl
+	switch p.phase {
+	case pclText:
+		switch b {
+		case 0x1b:
+			p.phase = pclEscape
+		case '\f':
+			if p.sawContent {
+				s.job.pages++
+				p.sawContent = false
+			}
+			p.marked = false
+		default:
+			if b > ' ' {
+				p.sawContent = true
+				p.marked = true
+			}
+		}
+	case pclEscape:
+		if b >= 0x21 && b <= 0x2f {
+			p.paramChar = b
+			p.groupChar = 0
+			p.value = p.value[:0]
+			p.phase = pclGroup
+		} else {
+			p.phase = pclText // Sequência de dois caracteres (ex: ESC E, reset)
+			if b == 'E' {
+				s.endPCLPage() // O reset ejeta a página em andamento
+			}
+		}
+	case pclGroup:
+		if b >= 0x60 && b <= 0x7e {
+			p.groupChar = b
+			p.phase = pclValue
+			return
+		}
+		// ESC % não tem caractere de grupo (ex: ESC%-12345X)
+		p.phase = pclValue
+		s.feedPCL(b)
+	case pclValue:
+		switch {
+		case b >= '0' && b <= '9' || b == '+' || b == '-' || b == '.':
+			if len(p.value) < 32 {
+				p.value = append(p.value, b)
+			}
+		case b >= 0x60 && b <= 0x7e: // Terminador minúsculo: a sequência continua combinada
+			s.pclCommand(b - 0x20)
+			p.value = p.value[:0]
+		case b >= 0x40 && b <= 0x5e: // Terminador maiúsculo: fim da sequência
+			p.phase = pclText
+			s.pclCommand(b)
+		default:
+			p.phase = pclText
+		}
+	case pclSkip:
+		p.skip--
+		if p.skip <= 0 {
+			p.phase = pclText
+		}
+	}
+}
+
+// pclCommand trata um comando PCL5 completo.
+func (s *pdlScanner) pclCommand(terminator byte) {
+	p := &s.pcl
+	value, _ := strconv.ParseFloat(string(p.value), 64)
+	n := int(value)
+
+	switch {
+	case p.paramChar == '%' && terminator == 'X' && n == -12345:
+		s.endPCLPage()
+		s.mode = pdlPJL // UEL: o restante do fluxo volta a ser PJL
+		s.line = s.line[:0]
+	case p.paramChar == '&' && p.groupChar == 'l' && terminator == 'X':
+		if n > 0 {
+			s.job.copies = n
+		}
+	case p.paramChar == '&' && p.groupChar == 'l' && terminator == 'H' && n == 0:
+		if p.sawContent {
+			s.job.pages++ // Ejeção explícita de página
+			p.sawContent = false
+		}
+		p.marked = false
+	case p.paramChar == '&' && p.groupChar == 'l' && terminator == 'A':
+		if paper := pclPaperSizes[n]; paper != "" {
+			s.job.paper = paper
+		}
+	case terminator == 'W' || p.paramChar == '&' && p.groupChar == 'p' && terminator == 'X':
+		// Dados binários (raster, fontes, texto transparente): n bytes a ignorar
+		if n > 0 {
+			p.skip = int64(n)
+			p.phase = pclSkip
+		}
+		p.sawContent = true
+		// Só raster e texto transparente imprimem algo; fontes e paletas também usam W
+		p.marked = p.marked || p.paramChar == '*' && p.groupChar == 'b' || p.paramChar == '&' && p.groupChar == 'p'
+	case p.paramChar == '*' && p.groupChar == 'c' && terminator == 'P':
+		p.sawContent = true
+		p.marked = true // Preenchimento de retângulo
+	default:
+		p.sawContent = true
+	}
+}
+
+// endPCLPage conta a última página de um fluxo PCL que termina sem form feed (reset, UEL ou fim
+// dos dados): a impressora ejeta a página em andamento se algo foi impresso nela. Comandos de
+// configuração soltos depois do último form feed não contam.
+func (s *pdlScanner) endPCLPage() {
+	p := &s.pcl
+	if p.marked {
+		s.job.pages++
+	}
+	p.marked = false
+	p.sawContent = false
+}
+
+// pclPaperSizes traduz os códigos de ESC&l#A.
+var pclPaperSizes = map[int]string{1: "Executive", 2: "Letter", 3: "Legal", 6: "Ledger", 25: "A5", 26: "A4", 27: "A3"}
+
+// --- PCL XL (PCL6) ---
+
+// xlState acompanha o fluxo binário do PCL XL, lendo só o suficiente para reconhecer o
+// operador EndPage e o atributo PageCopies.
+type xlState struct {
+	phase     int // xlHeader, xlTag, xlRead, xlArrayLen, xlSkip
+	bigEndian bool
+	buf       [16]byte
+	have      int
+	need      int
+	purpose   int // xlScalar, xlIgnore, xlAttrID, xlArrayCount, xlDataLength
+	elemSize  int64
+	skip      int64
+	lastValue uint32
+	copies    uint32
+}
+
+const (
+	xlHeader = iota
+	xlTag
+	xlRead
+	xlArrayLen
+	xlSkip
+)
+
+const (
+	xlScalar = iota
+	xlIgnore
+	xlAttrID
+	xlArrayCount
+	xlDataLength
+)
+
+// Identificadores do PCL XL usados na contagem.
+const (
+	xlOpEndPage       = 0x44
+	xlAttrPageCopies  = 0x31
+	xlAttrMediaSize   = 0x25
+	xlBindingLowFirst = ')'
+)
+
+// xlMediaSizes traduz os valores enumerados de MediaSize.
+var xlMediaSizes = map[uint32]string{0: "Letter", 1: "Legal", 2: "A4", 3: "Executive", 4: "Ledger", 5: "A3", 17: "A5"}
+
+// xlScalarSizes, xlXYSizes e xlBoxSizes dão o tamanho em bytes dos valores de cada tipo.
+var (
+	xlScalarSizes = map[byte]int{0xc0: 1, 0xc1: 2, 0xc2: 4, 0xc3: 2, 0xc4: 4, 0xc5: 4}
+	xlArraySizes  = map[byte]int64{0xc8: 1, 0xc9: 2, 0xca: 4, 0xcb: 2, 0xcc: 4, 0xcd: 4}
+	xlXYSizes     = map[byte]int{0xd0: 2, 0xd1: 4, 0xd2: 8, 0xd3: 4, 0xd4: 8, 0xd5: 8}
+	xlBoxSizes    = map[byte]int{0xe0: 4, 0xe1: 8, 0xe2: 16, 0xe3: 8, 0xe4: 16, 0xe5: 16}
+)
+
+func (s *pdlScanner) feedXL(b byte) {
+	x := &s.xl
+	switch x.phase {
+	case xlHeader:
+		// ") HP-PCL XL;2;0;..." até o fim da linha; o primeiro byte define a ordem dos bytes
+		if x.have == 0 {
+			if b == '\r' || b == '\n' || b == ' ' {
+				return // Resto da linha do "@PJL ENTER LANGUAGE"
+			}
+			x.bigEndian = b != xlBindingLowFirst
+			x.have = 1
+		}
+		if b == '\n' {
+			x.have = 0
+			x.phase = xlTag
+		}
+	case xlTag:
+		s.xlTag(b)
+	case xlRead:
+		x.buf[x.have] = b
+		x.have++
+		if x.have == x.need {
+			x.phase = xlTag
+			s.xlValue()
+		}
+	case xlArrayLen:
+		// O tamanho de um array vem como ubyte (0xc0) ou uint16 (0xc1)
+		switch b {
+		case 0xc0:
+			x.read(1, xlArrayCount)
+		case 0xc1:
+			x.read(2, xlArrayCount)
+		default:
+			x.phase = xlTag
+		}
+	case xlSkip:
+		x.skip--
+		if x.skip <= 0 {
+			x.phase = xlTag
+		}
+	}
+}
+
+// read prepara a leitura de n bytes de operando.
+func (x *xlState) read(n, purpose int) {
+	x.have = 0
+	x.need = n
+	x.purpose = purpose
+	x.phase = xlRead
+}
+
+// uint decodifica os bytes lidos conforme a ordem definida no cabeçalho do fluxo.
+func (x *xlState) uint() uint32 {
+	var v uint32
+	n := x.need
+	if n > 4 {
+		n = 4
+	}
+	for i := 0; i < n; i++ {
+		if x.bigEndian {
+			v = v<<8 | uint32(x.buf[i])
+		} else {
+			v |= uint32(x.buf[i]) << (8 * i)
+		}
+	}
+	return v
+}
+
+func (s *pdlScanner) xlTag(b byte) {
+	x := &s.xl
+	switch {
+	case b == 0x1b:
+		// ESC fora de dados: início do UEL de volta ao PJL
+		s.switchMode(pdlPCL)
+		s.job.language = pdlPCLXL
+		s.feedPCL(b)
+	case b == xlOpEndPage:
+		s.job.pages++
+		if x.copies > uint32(s.job.copies) {
+			s.job.copies = int(x.copies)
+		}
+	case xlScalarSizes[b] > 0:
+		x.read(xlScalarSizes[b], xlScalar)
+	case xlArraySizes[b] > 0:
+		x.elemSize = xlArraySizes[b]
+		x.phase = xlArrayLen
+	case xlXYSizes[b] > 0:
+		x.read(xlXYSizes[b], xlIgnore)
+	case xlBoxSizes[b] > 0:
+		x.read(xlBoxSizes[b], xlIgnore)
+	case b == 0xf8:
+		x.read(1, xlAttrID)
+	case b == 0xf9:
+		x.read(2, xlAttrID)
+	case b == 0xfa:
+		x.read(4, xlDataLength)
+	case b == 0xfb:
+		x.read(1, xlDataLength)
+	}
+	// Demais bytes: espaços em branco e operadores que não afetam a contagem
+}
+
+// xlValue trata um operando completo.
+func (s *pdlScanner) xlValue() {
+	x := &s.xl
+	switch x.purpose {
+	case xlScalar:
+		x.lastValue = x.uint()
+	case xlAttrID:
+		switch x.uint() {
+		case xlAttrPageCopies:
+			x.copies = x.lastValue
+		case xlAttrMediaSize:
+			if paper := xlMediaSizes[x.lastValue]; paper != "" {
+				s.job.paper = paper
+			}
+		}
+	case xlArrayCount:
+		if size := int64(x.uint()) * x.elemSize; size > 0 {
+			x.skip = size
+			x.phase = xlSkip
+		}
+	case xlDataLength:
+		if size := int64(x.uint()); size > 0 {
+			x.skip = size
+			x.phase = xlSkip
+		}
+	}
+}
+
+// feedOther ignora tudo até o UEL.
+func (s *pdlScanner) feedOther(b byte) {
+	if b == 0x1b {
+		s.line = append(s.line[:0], b)
+		return
+	}
+	if len(s.line) > 0 {
+		s.line = append(s.line, b)
+		if !bytes.HasPrefix(uel, s.line) {
+			s.line = s.line[:0]
+		} else if len(s.line) == len(uel) {
+			s.line = s.line[:0]
+			s.mode = pdlPJL
+		}
+	}
+}
+
+// --- PDF ---
+
+// pdfMaxBuffer limita quanto de um PDF é guardado em memória para contar as páginas; PDFs
+// maiores são contados pelo que couber (pelo menos uma página).
+const pdfMaxBuffer = 16 << 20
+
+// pdfMaxInflated limita o total descompactado dos object streams de um mesmo PDF.
+const pdfMaxInflated = 4 << 20
+
+var (
+	pdfPagesType = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdfCount     = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfPageLeaf  = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfStream    = regexp.MustCompile(`stream\r?\n`)
+	pdfObjStm    = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+)
+
+// documentCounter conta as páginas de um documento enviado por protocolo (IPP, LPD): PDFs são
+// reconhecidos pelo cabeçalho "%PDF-" e o restante passa pelo pdlScanner.
+type documentCounter struct {
+	head     []byte
+	pdl      *pdlScanner
+	pdf      *bytes.Buffer
+	pdfBytes int64
+}
+
+func newDocumentCounter() *documentCounter {
+	return &documentCounter{}
+}
+
+func (d *documentCounter) Write(p []byte) (int, error) {
+	if d.pdl == nil && d.pdf == nil {
+		// Aguarda os primeiros bytes para escolher o formato
+		d.head = append(d.head, p...)
+		if len(d.head) < 5 {
+			return len(p), nil
+		}
+		p, d.head = d.head, nil
+		if bytes.HasPrefix(p, []byte("%PDF-")) {
+			d.pdf = &bytes.Buffer{}
+		} else {
+			d.pdl = newPDLScanner()
+		}
+	}
+	if d.pdl != nil {
+		d.pdl.Write(p)
+		return len(p), nil
+	}
+	d.pdfBytes += int64(len(p))
+	if room := pdfMaxBuffer - d.pdf.Len(); room > 0 {
+		if len(p) > room {
+			d.pdf.Write(p[:room])
+		} else {
+			d.pdf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Jobs retorna os jobs encontrados no documento.
+func (d *documentCounter) Jobs() []pdlJob {
+	switch {
+	case d.pdf != nil:
+		pages := pdfPageCount(d.pdf.Bytes())
+		if pages == 0 {
+			pages = 1
+		}
+		return []pdlJob{{language: "PDF", pages: pages, copies: 1, bytes: d.pdfBytes}}
+	case d.pdl != nil:
+		return d.pdl.Jobs()
+	case len(d.head) > 0:
+		d.pdl = newPDLScanner()
+		d.pdl.Write(d.head)
+		return d.pdl.Jobs()
+	}
+	return nil
+}
+
+// pdfPageCount retorna o total de páginas de um PDF: o maior /Count entre os nós /Pages ou,
+// sem eles, o número de objetos /Page. Sem árvore de páginas visível, os object streams
+// compactados (PDF 1.5+) são descompactados, um por vez e até pdfMaxInflated no total, até o
+// primeiro que contenha a árvore. Retorna 0 se nada for encontrado.
+func pdfPageCount(data []byte) int {
+	if count := pdfMaxPagesCount(data); count > 0 {
+		return count
+	}
+
+	leaves := len(pdfPageLeaf.FindAllIndex(data, -1))
+	budget := pdfMaxInflated
+	for _, loc := range pdfStream.FindAllIndex(data, -1) {
+		if budget <= 0 {
+			break
+		}
+		// Só object streams guardam dicionários; conteúdo de página, imagens e fontes são pulados
+		start := bytes.LastIndex(data[:loc[0]], []byte("obj"))
+		if start < 0 || !pdfObjStm.Match(data[start:loc[0]]) {
+			continue
+		}
+		end := bytes.Index(data[loc[1]:], []byte("endstream"))
+		if end < 0 {
+			continue
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(data[loc[1] : loc[1]+end]))
+		if err != nil {
+			continue
+		}
+		inflated, _ := io.ReadAll(io.LimitReader(zr, int64(budget)))
+		zr.Close()
+		budget -= len(inflated)
+		if count := pdfMaxPagesCount(inflated); count > 0 {
+			return count
+		}
+		leaves += len(pdfPageLeaf.FindAllIndex(inflated, -1))
+	}
+	return leaves
+}
+
+// pdfMaxPagesCount retorna o maior /Count entre os nós /Pages de data, ou 0 se não houver.
+func pdfMaxPagesCount(data []byte) int {
+	maxCount := 0
+	for _, loc := range pdfPagesType.FindAllIndex(data, -1) {
+		dict, ok := pdfEnclosingDict(data, loc[0])
+		if !ok {
+			continue
+		}
+		if m := pdfCount.FindSubmatch(pdfTopLevel(dict)); m != nil {
+			if n, err := strconv.Atoi(string(m[1])); err == nil && n > maxCount {
+				maxCount = n
+			}
+		}
+	}
+	return maxCount
+}
+
+// pdfEnclosingDict retorna o conteúdo (sem "<<" e ">>") do dicionário que contém a posição pos
+// de data, respeitando dicionários aninhados como /Resources << ... >>.
+func pdfEnclosingDict(data []byte, pos int) ([]byte, bool) {
+	start, depth := -1, 0
+	for i := pos - 1; i > 0; i-- {
+		switch {
+		case data[i-1] == '<' && data[i] == '<':
+			if depth == 0 {
+				start = i + 1
+			} else {
+				depth--
+			}
+			i--
+		case data[i-1] == '>' && data[i] == '>':
+			depth++
+			i--
+		}
+		if start >= 0 {
+			break
+		}
+	}
+	if start < 0 {
+		return nil, false
+	}
+	depth = 0
+	for i := start; i+1 < len(data); i++ {
+		switch {
+		case data[i] == '<' && data[i+1] == '<':
+			depth++
+			i++
+		case data[i] == '>' && data[i+1] == '>':
+			if depth == 0 {
+				return data[start:i], true
+			}
+			depth--
+			i++
+		}
+	}
+	return nil, false
+}
+
+// pdfTopLevel retorna dict com os dicionários aninhados trocados por espaços, para que um
+// /Count de dentro deles (ex: em /Outlines) não seja tomado pelo do nó.
+func pdfTopLevel(dict []byte) []byte {
+	out := bytes.Clone(dict)
+	depth := 0
+	for i := 0; i < len(out); i++ {
+		switch {
+		case i+1 < len(out) && out[i] == '<' && out[i+1] == '<':
+			depth++
+		case i+1 < len(out) && out[i] == '>' && out[i+1] == '>' && depth > 0:
+			depth--
+		case depth > 0:
+			out[i] = ' '
+			continue
+		default:
+			continue
+		}
+		out[i], out[i+1] = ' ', ' '
+		i++
+	}
+	return out
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// writeChunks escreve data em pedaços pequenos, como chega pela rede, para que marcadores e
+// sequências de escape fiquem divididos entre chamadas a Write.
+func writeChunks(w interface{ Write([]byte) (int, error) }, data []byte) {
+	for len(data) > 0 {
+		n := min(3, len(data))
+		w.Write(data[:n])
+		data = data[n:]
+	}
+}
+
+func TestPDLScannerPageCounts(t *testing.T) {
+	xl := []byte("\x1b%-12345X@PJL JOB NAME=\"Planilha\"\r\n@PJL SET USERNAME=\"ana\"\r\n@PJL ENTER LANGUAGE=PCLXL\r\n" +
+		") HP-PCL XL;2;0;Comment\r\n")
+	xl = append(xl,
+		0x43,                   // BeginPage
+		0xc0, 0x02, 0xf8, 0x25, // MediaSize = A4
+		0xfb, 0x03, 0x44, 0x44, 0x44, // Dados embutidos com bytes iguais a EndPage
+		0x44,                   // EndPage
+		0xc0, 0x02, 0xf8, 0x31, // PageCopies = 2
+		0x43, 0xc0, 0x44, 0xf8, 0x99, 0x44, // Página com um valor 0x44 antes do EndPage
+	)
+	xl = append(xl, "\x1b%-12345X@PJL EOJ\r\n\x1b%-12345X"...)
+
+	tests := []struct {
+		name string
+		data string
+		want []pdlJob
+	}{
+		{
+			name: "PJL and PCL5",
+			data: "\x1b%-12345X@PJL JOB NAME=\"Relatorio\"\r\n@PJL SET USERNAME=\"joao\"\r\n@PJL SET QTY=2\r\n" +
+				"@PJL SET RENDERMODE=GRAYSCALE\r\n@PJL ENTER LANGUAGE=PCL\r\n\x1bE\x1b&l26A" +
+				"Pagina 1\fPagina 2\f\x1bE\x1b%-12345X@PJL EOJ\r\n\x1b%-12345X",
+			want: []pdlJob{{user: "joao", name: "Relatorio", paper: "A4", color: "GRAYSCALE", copies: 2, pages: 2, language: pdlPCL}},
+		},
+		{
+			name: "PCL5 last page ended by reset",
+			data: "\x1bEPagina 1\fPagina 2\fPagina 3\x1bE",
+			want: []pdlJob{{copies: 1, pages: 3, language: pdlPCL}},
+		},
+		{
+			name: "PCL5 last page ended by end of data",
+			data: "Pagina 1\fPagina 2",
+			want: []pdlJob{{copies: 1, pages: 2, language: pdlPCL}},
+		},
+		{
+			name: "PCL5 last page ended by UEL",
+			data: "\x1b%-12345X@PJL ENTER LANGUAGE=PCL\r\n\x1b*r1A\x1b*b4W\f\f\f\f\x1b*rB\x1b%-12345X",
+			want: []pdlJob{{copies: 1, pages: 1, language: pdlPCL}},
+		},
+		{
+			name: "PCL5 setup commands after the last form feed",
+			data: "\x1bE\x1b&l1XPagina 1\f\x1b&l0O\x1b(s4W\x00\x00\x00\x00\x1bE",
+			want: []pdlJob{{copies: 1, pages: 1, language: pdlPCL}},
+		},
+		{
+			name: "PCL XL",
+			data: string(xl),
+			want: []pdlJob{{user: "ana", name: "Planilha", paper: "A4", copies: 2, pages: 2, language: pdlPCLXL}},
+		},
+		{
+			name: "PostScript",
+			data: "%!PS-Adobe-3.0\n%%Title: (Memorando)\n%%For: (maria)\n%%Pages: 2\n%%EndComments\n" +
+				"<< /NumCopies 3 >> setpagedevice\n%%Page: 1 1\nshowpage\n%%Page: 2 2\nshowpage\n%%EOF\n",
+			want: []pdlJob{{user: "maria", name: "Memorando", copies: 3, pages: 2, language: pdlPostScript}},
+		},
+		{
+			name: "two PJL jobs on one connection",
+			data: "\x1b%-12345X@PJL JOB NAME=\"A\"\r\n@PJL ENTER LANGUAGE=PCL\r\nA1\fA2\f\x1b%-12345X@PJL EOJ\r\n" +
+				"\x1b%-12345X@PJL JOB NAME=\"B\"\r\n@PJL ENTER LANGUAGE=PCL\r\nB1\x1b%-12345X@PJL EOJ\r\n\x1b%-12345X",
+			want: []pdlJob{{name: "A", copies: 1, pages: 2, language: pdlPCL}, {name: "B", copies: 1, pages: 1, language: pdlPCL}},
+		},
+		{
+			name: "PJL status query only",
+			data: "\x1b%-12345X@PJL INFO STATUS\r\n\x1b%-12345X",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := newPDLScanner()
+			writeChunks(scanner, []byte(tt.data))
+			got := scanner.Jobs()
+
+			// bytes conta o fluxo de cada job; a contagem de páginas é o que interessa aqui
+			for i := range got {
+				got[i].bytes = 0
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Jobs:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// pdfObjectStream monta um object stream compactado com o conteúdo dado.
+func pdfObjectStream(t *testing.T, number int, content string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(content))
+	zw.Close()
+	return fmt.Sprintf("%d 0 obj\n<< /Type /ObjStm /N 1 /First 4 /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream\nendobj\n", number, buf.Len(), buf.String())
+}
+
+// pdfFlateStream monta um stream compactado comum (ex: conteúdo de página).
+func pdfFlateStream(t *testing.T, number int, content string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(content))
+	zw.Close()
+	return fmt.Sprintf("%d 0 obj\n<< /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream\nendobj\n", number, buf.Len(), buf.String())
+}
+
+func TestDocumentCounterPDF(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		pages int
+	}{
+		{
+			name: "page tree",
+			data: "%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+				"2 0 obj\n<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 5 >>\nendobj\n" +
+				"3 0 obj\n<< /Type /Pages /Parent 2 0 R /Kids [5 0 R 6 0 R] /Count 2 >>\nendobj\n" +
+				"%%EOF\n",
+			pages: 5,
+		},
+		{
+			name: "pages node with nested resources dictionary",
+			data: "%PDF-1.5\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R /Outlines << /Count 40 >> >>\nendobj\n" +
+				"2 0 obj\n<< /Type /Pages /Resources << /Font << /F1 7 0 R >> /ProcSet [/PDF /Text] >> /Kids [3 0 R] /Count 12 >>\nendobj\n" +
+				pdfObjectStream(t, 6, "3 0 << /Type /Page /Parent 2 0 R >>") +
+				"%%EOF\n",
+			pages: 12,
+		},
+		{
+			name:  "count before type and after a nested dictionary",
+			data:  "%PDF-1.4\n2 0 obj\n<< /Count 4 /Resources << /Count 9 >> /Type /Pages /Kids [3 0 R] >>\nendobj\n%%EOF\n",
+			pages: 4,
+		},
+		{
+			name: "page objects only",
+			data: "%PDF-1.3\n3 0 obj\n<< /Type /Page /Parent 2 0 R >>\nendobj\n" +
+				"4 0 obj\n<< /Type /Page /Parent 2 0 R >>\nendobj\n%%EOF\n",
+			pages: 2,
+		},
+		{
+			name: "page tree in a compressed object stream",
+			data: "%PDF-1.5\n" +
+				pdfFlateStream(t, 5, strings.Repeat("BT /F1 12 Tf (<< /Type /Pages /Count 99 >>) Tj ET\n", 20)) +
+				pdfObjectStream(t, 6, "2 0 << /Type /Pages /Kids [3 0 R] /Count 7 >>") +
+				"%%EOF\n",
+			pages: 7,
+		},
+		{
+			name:  "nothing recognizable",
+			data:  "%PDF-1.7\n%%EOF\n",
+			pages: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := newDocumentCounter()
+			writeChunks(counter, []byte(tt.data))
+			jobs := counter.Jobs()
+			if len(jobs) != 1 {
+				t.Fatalf("got %d job(s), want 1", len(jobs))
+			}
+			if jobs[0].language != "PDF" || jobs[0].pages != tt.pages || jobs[0].bytes != int64(len(tt.data)) {
+				t.Errorf("got %+v, want %d page(s) of PDF in %d byte(s)", jobs[0], tt.pages, len(tt.data))
+			}
+		})
+	}
+}
+
+func TestDocumentCounterPCL(t *testing.T) {
+	data := "\x1bEPagina 1\fPagina 2\x1bE"
+	counter := newDocumentCounter()
+	writeChunks(counter, []byte(data))
+	jobs := counter.Jobs()
+	if len(jobs) != 1 || jobs[0].language != pdlPCL || jobs[0].pages != 2 || jobs[0].bytes != int64(len(data)) {
+		t.Errorf("got %+v, want one PCL job with 2 page(s)", jobs)
+	}
+}
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Tags BER (ASN.1) e tipos de aplicação do SNMP (RFC 3416).
+const (
+	berInteger      = 0x02
+	berOctetString  = 0x04
+	berNull         = 0x05
+	berOID          = 0x06
+	berSequence     = 0x30
+	snmpCounter32   = 0x41
+	snmpGauge32     = 0x42
+	snmpTimeTicks   = 0x43
+	snmpCounter64   = 0x46
+	snmpNoSuchObj   = 0x80
+	snmpNoSuchInst  = 0x81
+	snmpEndOfMib    = 0x82
+	snmpPDUGet      = 0xa0
+	snmpPDUGetNext  = 0xa1
+	snmpPDUResponse = 0xa2
+	snmpPDUReport   = 0xa8
+)
+
+// Versões aceitas em SNMPPrinterConfig.Version.
+const (
+	snmpVersion1  = "1"
+	snmpVersion2c = "2c"
+	snmpVersion3  = "3"
+)
+
+// Flags de segurança do SNMPv3 (msgFlags).
+const (
+	snmpFlagAuth       = 0x01
+	snmpFlagPriv       = 0x02
+	snmpFlagReportable = 0x04
+)
+
+// Contadores do USM (RFC 3414) devolvidos em PDUs Report.
+const (
+	usmStatsNotInTimeWindows = "1.3.6.1.6.3.15.1.1.2.0"
+	usmStatsUnknownUserNames = "1.3.6.1.6.3.15.1.1.3.0"
+	usmStatsUnknownEngineIDs = "1.3.6.1.6.3.15.1.1.4.0"
+	usmStatsWrongDigests     = "1.3.6.1.6.3.15.1.1.5.0"
+	usmStatsDecryptionErrors = "1.3.6.1.6.3.15.1.1.6.0"
+)
+
+// snmpTimeout e snmpRetries controlam a espera por cada resposta UDP.
+const (
+	snmpTimeout = 3 * time.Second
+	snmpRetries = 2
+)
+
+// snmpMaxWalk limita quantas linhas um walk lê, para não percorrer a MIB inteira de um agente
+// com implementação defeituosa.
+const snmpMaxWalk = 256
+
+// snmpStatusNoSuchName é o error-status com que agentes v1 respondem a um OID inexistente ou
+// ao GETNEXT além do fim da MIB.
+const snmpStatusNoSuchName = 2
+
+// Reports do USM que indicam que o estado do SNMPv3 guardado (engineID, boots e time) não vale
+// mais, normalmente porque o agente reiniciou ou foi trocado.
+var (
+	errSNMPNotInTimeWindow = errors.New("SNMPv3 agent rejected the request time window")
+	errSNMPUnknownEngineID = errors.New("SNMPv3 agent rejected the engineID")
+)
+
+var snmpRequestID atomic.Int32
+
+// snmpStatusError é uma resposta com error-status diferente de noError.
+type snmpStatusError struct {
+	addr   string
+	status int64
+	index  int64
+}
+
+func (e *snmpStatusError) Error() string {
+	return fmt.Sprintf("SNMP agent %s returned %s (index %d)", e.addr, snmpErrorName(e.status), e.index)
+}
+
+// snmpNeedsRediscovery informa se err indica que o agente SNMPv3 pode ter reiniciado: um Report
+// de janela de tempo ou engineID, ou nenhuma resposta.
+func snmpNeedsRediscovery(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, errSNMPNotInTimeWindow) || errors.Is(err, errSNMPUnknownEngineID) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// snmpVarBind é um OID com o valor devolvido pelo agente.
+type snmpVarBind struct {
+	oid   string
+	tag   byte
+	value []byte
+}
+
+// int64Value converte INTEGER, Counter32, Gauge32, TimeTicks e Counter64 em inteiro.
+func (v snmpVarBind) int64Value() (int64, bool) {
+	switch v.tag {
+	case berInteger:
+		if len(v.value) == 0 || len(v.value) > 4 {
+			return 0, false
+		}
+		n := berUint(v.value)
+		if v.value[0]&0x80 != 0 {
+			n -= int64(1) << (8 * uint(len(v.value))) // Negativo em complemento de dois
+		}
+		return n, true
+	case snmpCounter32, snmpGauge32, snmpTimeTicks, snmpCounter64:
+		value := bytes.TrimLeft(v.value, "\x00")
+		if len(v.value) == 0 || len(value) > 8 || (len(value) == 8 && value[0]&0x80 != 0) {
+			return 0, false
+		}
+		return berUint(value), true
+	}
+	return 0, false
+}
+
+// exists informa se o agente devolveu um valor (e não noSuchObject/noSuchInstance/endOfMibView).
+func (v snmpVarBind) exists() bool {
+	return v.tag != snmpNoSuchObj && v.tag != snmpNoSuchInst && v.tag != snmpEndOfMib && v.tag != berNull
+}
+
+// snmpClient faz requisições GET/GETNEXT a um agente, em v1, v2c ou v3 (USM).
+type snmpClient struct {
+	cfg  *SNMPPrinterConfig
+	addr string
+
+	// Estado do SNMPv3, descoberto no primeiro acesso
+	engineID   []byte
+	engineBoot int64
+	engineTime int64
+	discovered time.Time
+	authKey    []byte
+	privKey    []byte
+	salt       uint64
+}
+
+func newSNMPClient(pc *SNMPPrinterConfig) (*snmpClient, error) {
+	addr := pc.Address
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "161")
+	}
+	switch pc.Version {
+	case snmpVersion1, snmpVersion2c:
+	case snmpVersion3:
+		if pc.User == "" {
+			return nil, errors.New("user is required for SNMPv3")
+		}
+		if _, err := snmpAuthHash(pc.AuthProtocol); err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(pc.PrivProtocol) {
+		case "", "DES", "AES":
+		default:
+			return nil, fmt.Errorf("unknown SNMPv3 privProtocol '%s' (expected DES or AES)", pc.PrivProtocol)
+		}
+		if pc.PrivProtocol != "" && pc.AuthProtocol == "" {
+			return nil, errors.New("SNMPv3 privacy requires authProtocol")
+		}
+	default:
+		return nil, fmt.Errorf("unknown SNMP version '%s' (expected '%s', '%s' or '%s')", pc.Version, snmpVersion1, snmpVersion2c, snmpVersion3)
+	}
+	c := &snmpClient{cfg: pc, addr: addr}
+	var salt [8]byte
+	rand.Read(salt[:])
+	c.salt = binary.BigEndian.Uint64(salt[:])
+	return c, nil
+}
+
+// get lê os OIDs pedidos. OIDs inexistentes voltam com tag noSuchObject (v2c/v3) ou causam
+// erro noSuchName (v1).
+func (c *snmpClient) get(oids ...string) ([]snmpVarBind, error) {
+	return c.request(snmpPDUGet, oids)
+}
+
+// walk lê a subárvore de root com GETNEXT.
+func (c *snmpClient) walk(root string) ([]snmpVarBind, error) {
+	var result []snmpVarBind
+	next := root
+	for len(result) < snmpMaxWalk {
+		binds, err := c.request(snmpPDUGetNext, []string{next})
+		if err != nil {
+			var statusErr *snmpStatusError
+			if len(result) > 0 && errors.As(err, &statusErr) && statusErr.status == snmpStatusNoSuchName {
+				break // Fim da MIB em v1
+			}
+			return nil, err
+		}
+		vb := binds[0]
+		if !vb.exists() || !strings.HasPrefix(vb.oid, root+".") || vb.oid == next {
+			break
+		}
+		result = append(result, vb)
+		next = vb.oid
+	}
+	return result, nil
+}
+
+// request envia uma PDU e espera a resposta, repetindo em caso de timeout.
+func (c *snmpClient) request(pduType byte, oids []string) ([]snmpVarBind, error) {
+	if c.cfg.Version == snmpVersion3 && c.engineID == nil {
+		if err := c.discover(); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.Dial("udp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket to %s: %w", c.addr, err)
+	}
+	defer conn.Close()
+
+	resynced := false
+	for attempt := 0; ; attempt++ {
+		requestID := snmpRequestID.Add(1) & 0x7fffffff
+		pdu, err := encodeSNMPPDU(pduType, requestID, oids)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := c.wrap(pdu, requestID, false)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := exchangeUDP(conn, msg)
+		if err != nil {
+			if attempt < snmpRetries {
+				continue
+			}
+			return nil, fmt.Errorf("no SNMP response from %s: %w", c.addr, err)
+		}
+		respType, respID, errStatus, errIndex, binds, err := c.unwrap(reply)
+		if err != nil {
+			return nil, err
+		}
+		if respType == snmpPDUReport {
+			// Relógio do agente mudou (reinício): atualiza e tenta uma vez mais
+			if len(binds) > 0 && binds[0].oid == usmStatsNotInTimeWindows && !resynced {
+				resynced = true
+				continue
+			}
+			return nil, snmpReportError(binds)
+		}
+		if respID != requestID {
+			if attempt < snmpRetries {
+				continue // Resposta atrasada de uma tentativa anterior
+			}
+			return nil, fmt.Errorf("SNMP response from %s has unexpected request-id", c.addr)
+		}
+		if errStatus != 0 {
+			return nil, &snmpStatusError{addr: c.addr, status: errStatus, index: errIndex}
+		}
+		if respType != snmpPDUResponse || len(binds) != len(oids) {
+			return nil, fmt.Errorf("SNMP agent %s returned an unexpected PDU", c.addr)
+		}
+		return binds, nil
+	}
+}
+
+// discover obtém o engineID, boots e time do agente SNMPv3 (RFC 3414, 4) e localiza as chaves.
+func (c *snmpClient) discover() error {
+	conn, err := net.Dial("udp", c.addr)
+	if err != nil {
+		return fmt.Errorf("failed to open UDP socket to %s: %w", c.addr, err)
+	}
+	defer conn.Close()
+
+	// Sem chaves, a resposta (não autenticada) da descoberta pode definir o engineID; elas são
+	// localizadas de novo para o engineID obtido
+	c.authKey, c.privKey = nil, nil
+	requestID := snmpRequestID.Add(1) & 0x7fffffff
+	pdu, _ := encodeSNMPPDU(snmpPDUGet, requestID, nil)
+	msg, _ := c.wrap(pdu, requestID, true)
+	var reply []byte
+	for attempt := 0; attempt <= snmpRetries; attempt++ {
+		if reply, err = exchangeUDP(conn, msg); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("no SNMPv3 discovery response from %s: %w", c.addr, err)
+	}
+	if _, _, _, _, _, err := c.unwrap(reply); err != nil {
+		return err
+	}
+	if len(c.engineID) == 0 {
+		return fmt.Errorf("SNMPv3 agent %s did not report its engineID", c.addr)
+	}
+
+	if c.cfg.AuthProtocol != "" {
+		newHash, _ := snmpAuthHash(c.cfg.AuthProtocol)
+		c.authKey = localizeKey(newHash, c.cfg.AuthPassword, c.engineID)
+		if c.cfg.PrivProtocol != "" {
+			c.privKey = localizeKey(newHash, c.cfg.PrivPassword, c.engineID)
+			if strings.EqualFold(c.cfg.PrivProtocol, "AES") && len(c.privKey) < 16 {
+				return errors.New("SNMPv3 AES privacy requires a key of at least 16 bytes")
+			}
+		}
+	}
+	return nil
+}
+
+// exchangeUDP envia uma mensagem e lê a resposta.
+func exchangeUDP(conn net.Conn, msg []byte) ([]byte, error) {
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(snmpTimeout))
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// wrap monta a mensagem completa: comunidade (v1/v2c) ou cabeçalho e segurança USM (v3). Na
+// descoberta do SNMPv3, a mensagem vai sem usuário nem autenticação.
+func (c *snmpClient) wrap(pdu []byte, msgID int32, discovery bool) ([]byte, error) {
+	if c.cfg.Version != snmpVersion3 {
+		version := int64(0)
+		if c.cfg.Version == snmpVersion2c {
+			version = 1
+		}
+		community := c.cfg.Community
+		if community == "" {
+			community = "public"
+		}
+		return berTLV(berSequence, berConcat(berInt(version), berTLV(berOctetString, []byte(community)), pdu)), nil
+	}
+
+	flags := byte(snmpFlagReportable)
+	user := []byte(nil)
+	boots, engineTime := int64(0), int64(0)
+	authParams, privParams := []byte{}, []byte{}
+	scoped := berTLV(berSequence, berConcat(berTLV(berOctetString, c.engineID), berTLV(berOctetString, nil), pdu))
+	secure := !discovery && c.authKey != nil
+	if !discovery {
+		user = []byte(c.cfg.User)
+		boots = c.engineBoot
+		engineTime = c.engineTime + int64(time.Since(c.discovered).Seconds())
+	}
+	if secure {
+		flags |= snmpFlagAuth
+		authParams = make([]byte, snmpAuthLength(c.cfg.AuthProtocol))
+		if c.privKey != nil {
+			flags |= snmpFlagPriv
+			encrypted, salt, err := c.encrypt(scoped, boots, engineTime)
+			if err != nil {
+				return nil, err
+			}
+			scoped = berTLV(berOctetString, encrypted)
+			privParams = salt
+		}
+	}
+
+	header := berTLV(berSequence, berConcat(berInt(int64(msgID)), berInt(65507), berTLV(berOctetString, []byte{flags}), berInt(3)))
+	secPrefix := berConcat(berTLV(berOctetString, c.engineID), berInt(boots), berInt(engineTime), berTLV(berOctetString, user))
+	authTLV := berTLV(berOctetString, authParams)
+	security := berTLV(berSequence, berConcat(secPrefix, authTLV, berTLV(berOctetString, privParams)))
+	msg := berTLV(berSequence, berConcat(berInt(3), header, berTLV(berOctetString, security), scoped))
+
+	if secure {
+		// O HMAC é calculado com authParams zerado e depois gravado no lugar dele
+		pos := bytes.Index(msg, berConcat(secPrefix, authTLV))
+		if pos < 0 {
+			return nil, errors.New("failed to locate SNMPv3 authentication parameters")
+		}
+		pos += len(secPrefix) + len(authTLV) - len(authParams)
+		copy(msg[pos:], c.digest(msg))
+	}
+	return msg, nil
+}
+
+// unwrap decodifica a resposta e retorna o tipo de PDU, request-id, error-status, error-index
+// e os varbinds. Em v3, atualiza engineID/boots/time e verifica autenticação e cifra.
+func (c *snmpClient) unwrap(msg []byte) (byte, int32, int64, int64, []snmpVarBind, error) {
+	fail := func(err error) (byte, int32, int64, int64, []snmpVarBind, error) {
+		return 0, 0, 0, 0, nil, fmt.Errorf("invalid SNMP response from %s: %w", c.addr, err)
+	}
+	tag, body, _, err := berRead(msg)
+	if err != nil || tag != berSequence {
+		return fail(errors.New("message is not a sequence"))
+	}
+	_, versionRaw, body, err := berRead(body)
+	if err != nil {
+		return fail(err)
+	}
+
+	var pdu []byte
+	if len(versionRaw) == 1 && versionRaw[0] == 3 {
+		var header, security, scoped []byte
+		if _, header, body, err = berRead(body); err != nil {
+			return fail(err)
+		}
+		if _, security, body, err = berRead(body); err != nil {
+			return fail(err)
+		}
+		scopedTag, scopedBody, _, err := berRead(body)
+		if err != nil {
+			return fail(err)
+		}
+		scoped = scopedBody
+
+		fields, err := berReadAll(header)
+		if err != nil || len(fields) < 3 || len(fields[2]) != 1 {
+			return fail(errors.New("malformed SNMPv3 header"))
+		}
+		flags := fields[2][0]
+
+		_, secSeq, _, err := berRead(security)
+		if err != nil {
+			return fail(err)
+		}
+		sec, err := berReadAll(secSeq)
+		if err != nil || len(sec) < 6 {
+			return fail(errors.New("malformed USM security parameters"))
+		}
+		boots, engineTime := berUint(sec[1]), berUint(sec[2])
+
+		// Com as chaves já localizadas, engineID/boots/time só são aceitos de mensagens
+		// autenticadas; as demais (ex: reports sem autenticação) não mexem no estado do agente
+		trusted := c.authKey == nil
+		if flags&snmpFlagAuth != 0 && c.authKey != nil {
+			// O HMAC é conferido com msgAuthenticationParameters zerado na posição em que foi
+			// lido, e não na primeira sequência de bytes igual a ele
+			authParams := sec[4]
+			pos, ok := berOffset(msg, authParams)
+			if !ok || len(authParams) == 0 {
+				return fail(errors.New("missing authentication parameters"))
+			}
+			zeroed := bytes.Clone(msg)
+			clear(zeroed[pos : pos+len(authParams)])
+			if !hmac.Equal(c.digest(zeroed), authParams) {
+				return fail(errors.New("authentication digest mismatch"))
+			}
+			trusted = true
+		}
+		if trusted {
+			c.engineID = append([]byte(nil), sec[0]...)
+			c.engineBoot = boots
+			c.engineTime = engineTime
+			c.discovered = time.Now()
+		}
+
+		if flags&snmpFlagPriv != 0 {
+			if c.privKey == nil || scopedTag != berOctetString || flags&snmpFlagAuth == 0 {
+				return fail(errors.New("encrypted response without privacy configured"))
+			}
+			plain, err := c.decrypt(scoped, sec[5], boots, engineTime)
+			if err != nil {
+				return fail(err)
+			}
+			if _, scoped, _, err = berRead(plain); err != nil {
+				return fail(errors.New("decryption failed"))
+			}
+		}
+		// scopedPDU: contextEngineID, contextName, PDU
+		if _, _, scoped, err = berRead(scoped); err != nil {
+			return fail(err)
+		}
+		if _, _, scoped, err = berRead(scoped); err != nil {
+			return fail(err)
+		}
+		pdu = scoped
+	} else {
+		if _, _, body, err = berRead(body); err != nil { // Comunidade
+			return fail(err)
+		}
+		pdu = body
+	}
+
+	pduType, pduBody, _, err := berRead(pdu)
+	if err != nil {
+		return fail(err)
+	}
+	fields, err := berReadAll(pduBody)
+	if err != nil || len(fields) < 4 {
+		return fail(errors.New("malformed PDU"))
+	}
+	binds, err := decodeVarBinds(fields[3])
+	if err != nil {
+		return fail(err)
+	}
+	return pduType, int32(berUint(fields[0])), berUint(fields[1]), berUint(fields[2]), binds, nil
+}
+
+// digest calcula o HMAC truncado do USM para a mensagem.
+func (c *snmpClient) digest(msg []byte) []byte {
+	newHash, _ := snmpAuthHash(c.cfg.AuthProtocol)
+	mac := hmac.New(newHash, c.authKey)
+	mac.Write(msg)
+	return mac.Sum(nil)[:snmpAuthLength(c.cfg.AuthProtocol)]
+}
+
+// encrypt cifra a scopedPDU com DES-CBC (RFC 3414, 8) ou AES-128-CFB (RFC 3826) e retorna o
+// texto cifrado e o salt enviado em msgPrivacyParameters.
+func (c *snmpClient) encrypt(plain []byte, boots, engineTime int64) ([]byte, []byte, error) {
+	c.salt++
+	salt := make([]byte, 8)
+	if strings.EqualFold(c.cfg.PrivProtocol, "AES") {
+		binary.BigEndian.PutUint64(salt, c.salt)
+		block, err := aes.NewCipher(c.privKey[:16])
+		if err != nil {
+			return nil, nil, err
+		}
+		out := make([]byte, len(plain))
+		cipher.NewCFBEncrypter(block, aesIV(boots, engineTime, salt)).XORKeyStream(out, plain)
+		return out, salt, nil
+	}
+
+	binary.BigEndian.PutUint32(salt, uint32(boots))
+	binary.BigEndian.PutUint32(salt[4:], uint32(c.salt))
+	block, err := des.NewCipher(c.privKey[:8])
+	if err != nil {
+		return nil, nil, err
+	}
+	padded := append(bytes.Clone(plain), make([]byte, (8-len(plain)%8)%8)...)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, desIV(c.privKey, salt)).CryptBlocks(out, padded)
+	return out, salt, nil
+}
+
+// decrypt reverte encrypt com o salt recebido.
+func (c *snmpClient) decrypt(data, salt []byte, boots, engineTime int64) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, errors.New("invalid privacy parameters")
+	}
+	if strings.EqualFold(c.cfg.PrivProtocol, "AES") {
+		block, err := aes.NewCipher(c.privKey[:16])
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, len(data))
+		cipher.NewCFBDecrypter(block, aesIV(boots, engineTime, salt)).XORKeyStream(out, data)
+		return out, nil
+	}
+	if len(data)%8 != 0 {
+		return nil, errors.New("encrypted PDU is not a multiple of the DES block size")
+	}
+	block, err := des.NewCipher(c.privKey[:8])
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, desIV(c.privKey, salt)).CryptBlocks(out, data)
+	return out, nil
+}
+
+func aesIV(boots, engineTime int64, salt []byte) []byte {
+	iv := binary.BigEndian.AppendUint32(nil, uint32(boots))
+	iv = binary.BigEndian.AppendUint32(iv, uint32(engineTime))
+	return append(iv, salt...)
+}
+
+func desIV(privKey, salt []byte) []byte {
+	iv := make([]byte, 8)
+	for i := range iv {
+		iv[i] = privKey[8+i] ^ salt[i]
+	}
+	return iv
+}
+
+// snmpAuthHash retorna a função de hash do authProtocol ("" sem autenticação).
+func snmpAuthHash(protocol string) (func() hash.Hash, error) {
+	switch strings.ToUpper(protocol) {
+	case "":
+		return nil, nil
+	case "MD5":
+		return md5.New, nil
+	case "SHA", "SHA1":
+		return sha1.New, nil
+	case "SHA256":
+		return sha256.New, nil
+	}
+	return nil, fmt.Errorf("unknown SNMPv3 authProtocol '%s' (expected MD5, SHA or SHA256)", protocol)
+}
+
+// snmpAuthLength é o tamanho do HMAC truncado: 12 bytes (MD5/SHA) ou 24 (SHA-256, RFC 7860).
+func snmpAuthLength(protocol string) int {
+	if strings.EqualFold(protocol, "SHA256") {
+		return 24
+	}
+	return 12
+}
+
+// passwordToKey deriva a chave do usuário da senha: hash de 1 MB da senha repetida
+// (RFC 3414, A.2).
+func passwordToKey(newHash func() hash.Hash, password string) []byte {
+	h := newHash()
+	if password != "" {
+		buf := make([]byte, 0, 1<<20+len(password))
+		for len(buf) < 1<<20 {
+			buf = append(buf, password...)
+		}
+		h.Write(buf[:1<<20])
+	}
+	return h.Sum(nil)
+}
+
+// localizeKey deriva a chave do usuário e a localiza no engineID do agente (RFC 3414, A.2).
+func localizeKey(newHash func() hash.Hash, password string, engineID []byte) []byte {
+	ku := passwordToKey(newHash, password)
+	h := newHash()
+	h.Write(ku)
+	h.Write(engineID)
+	h.Write(ku)
+	return h.Sum(nil)
+}
+
+// snmpReportError descreve o Report recebido no lugar da resposta.
+func snmpReportError(binds []snmpVarBind) error {
+	if len(binds) == 0 {
+		return errors.New("SNMPv3 agent returned an empty report")
+	}
+	switch binds[0].oid {
+	case usmStatsUnknownUserNames:
+		return errors.New("SNMPv3 agent does not know the configured user")
+	case usmStatsWrongDigests:
+		return errors.New("SNMPv3 authentication failed (wrong password or authProtocol)")
+	case usmStatsDecryptionErrors:
+		return errors.New("SNMPv3 decryption failed (wrong privPassword or privProtocol)")
+	case usmStatsNotInTimeWindows:
+		return errSNMPNotInTimeWindow
+	case usmStatsUnknownEngineIDs:
+		return errSNMPUnknownEngineID
+	}
+	return fmt.Errorf("SNMPv3 agent returned report %s", binds[0].oid)
+}
+
+// snmpErrorName traduz o error-status da PDU.
+func snmpErrorName(status int64) string {
+	names := []string{"noError", "tooBig", "noSuchName", "badValue", "readOnly", "genErr", "noAccess", "wrongType", "wrongLength", "wrongEncoding", "wrongValue", "noCreation", "inconsistentValue", "resourceUnavailable", "commitFailed", "undoFailed", "authorizationError", "notWritable", "inconsistentName"}
+	if status >= 0 && status < int64(len(names)) {
+		return names[status]
+	}
+	return fmt.Sprintf("error %d", status)
+}
+
+// encodeSNMPPDU monta uma PDU de GET/GETNEXT com valores NULL.
+func encodeSNMPPDU(pduType byte, requestID int32, oids []string) ([]byte, error) {
+	var binds []byte
+	for _, oid := range oids {
+		encoded, err := berEncodeOID(oid)
+		if err != nil {
+			return nil, err
+		}
+		binds = append(binds, berTLV(berSequence, berConcat(encoded, []byte{berNull, 0}))...)
+	}
+	return berTLV(pduType, berConcat(berInt(int64(requestID)), berInt(0), berInt(0), berTLV(berSequence, binds))), nil
+}
+
+// decodeVarBinds lê a lista de varbinds de uma PDU.
+func decodeVarBinds(data []byte) ([]snmpVarBind, error) {
+	var binds []snmpVarBind
+	for len(data) > 0 {
+		_, bind, rest, err := berRead(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		oidTag, oidRaw, value, err := berRead(bind)
+		if err != nil || oidTag != berOID {
+			return nil, errors.New("malformed varbind")
+		}
+		valueTag, valueRaw, _, err := berRead(value)
+		if err != nil {
+			return nil, err
+		}
+		binds = append(binds, snmpVarBind{oid: berDecodeOID(oidRaw), tag: valueTag, value: valueRaw})
+	}
+	return binds, nil
+}
+
+// berTLV codifica tag, tamanho e conteúdo.
+func berTLV(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	default:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+func berConcat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// berInt codifica um INTEGER com o menor número de bytes em complemento de dois.
+func berInt(v int64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(v))
+	for len(b) > 1 && ((b[0] == 0 && b[1]&0x80 == 0) || (b[0] == 0xff && b[1]&0x80 != 0)) {
+		b = b[1:]
+	}
+	return berTLV(berInteger, b)
+}
+
+// berUint lê um inteiro sem sinal (usado para request-id, error-status e campos do USM).
+func berUint(b []byte) int64 {
+	var v int64
+	for _, c := range b {
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+// berRead lê um elemento e retorna a tag, o conteúdo e o restante dos dados.
+func berRead(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errors.New("truncated BER element")
+	}
+	tag, length, pos := data[0], int(data[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(data) < 2+n {
+			return 0, nil, nil, errors.New("invalid BER length")
+		}
+		length = 0
+		for _, c := range data[2 : 2+n] {
+			length = length<<8 | int(c)
+		}
+		pos += n
+	}
+	if len(data) < pos+length {
+		return 0, nil, nil, errors.New("truncated BER element")
+	}
+	return tag, data[pos : pos+length], data[pos+length:], nil
+}
+
+// berOffset retorna a posição de part dentro de data. part precisa ser um pedaço de data
+// obtido por berRead (mesmo array), como os campos de uma mensagem decodificada.
+func berOffset(data, part []byte) (int, bool) {
+	pos := cap(data) - cap(part)
+	if pos < 0 || pos+len(part) > len(data) || !bytes.Equal(data[pos:pos+len(part)], part) {
+		return 0, false
+	}
+	return pos, true
+}
+
+// berReadAll lê todos os elementos de uma sequência e retorna seus conteúdos.
+func berReadAll(data []byte) ([][]byte, error) {
+	var out [][]byte
+	for len(data) > 0 {
+		_, content, rest, err := berRead(data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, content)
+		data = rest
+	}
+	return out, nil
+}
+
+// berEncodeOID codifica um OID em notação de pontos (ex: "1.3.6.1.2.1.43.10.2.1.4.1.1").
+func berEncodeOID(oid string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID '%s'", oid)
+	}
+	arcs := make([]uint64, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID '%s'", oid)
+		}
+		arcs[i] = v
+	}
+	out := []byte{byte(arcs[0]*40 + arcs[1])}
+	for _, arc := range arcs[2:] {
+		var enc []byte
+		enc = append(enc, byte(arc&0x7f))
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			enc = append([]byte{byte(arc&0x7f) | 0x80}, enc...)
+		}
+		out = append(out, enc...)
+	}
+	return berTLV(berOID, out), nil
+}
+
+// berDecodeOID converte o conteúdo de um OID para notação de pontos.
+func berDecodeOID(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	parts := []string{strconv.Itoa(int(data[0]) / 40), strconv.Itoa(int(data[0]) % 40)}
+	var arc uint64
+	for _, c := range data[1:] {
+		arc = arc<<7 | uint64(c&0x7f)
+		if c&0x80 == 0 {
+			parts = append(parts, strconv.FormatUint(arc, 10))
+			arc = 0
+		}
+	}
+	return strings.Join(parts, ".")
+}
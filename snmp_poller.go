@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// snmpDefaultPollInterval é o intervalo de leitura quando pollIntervalSeconds não é informado.
+const snmpDefaultPollInterval = 15 * time.Minute
+
+// OIDs da Printer-MIB (RFC 3805).
+const (
+	oidPrtMarkerLifeCount     = "1.3.6.1.2.1.43.10.2.1.4"   // Páginas impressas desde a fabricação, por marcador
+	oidPrtGeneralSerialNumber = "1.3.6.1.2.1.43.5.1.1.17.1" // Número de série do dispositivo
+)
+
+// CounterSnapshot é uma leitura dos contadores de uma impressora, enviada para
+// /central/receptprintercounters. Os deltas são calculados contra a última leitura aceita pela
+// API: se um envio falhar, o próximo cobre os dois intervalos.
+type CounterSnapshot struct {
+	Impressora        string `json:"impressora"`
+	Endereco          string `json:"endereco"`
+	NumeroSerie       string `json:"numeroserie,omitempty"`
+	Timestamp         string `json:"timestamp"`    // RFC 3339 com offset
+	TotalPaginas      int64  `json:"totalpaginas"` // Soma de prtMarkerLifeCount
+	PaginasCor        *int64 `json:"paginascor,omitempty"`
+	PaginasPB         *int64 `json:"paginaspb,omitempty"`
+	DeltaTotal        int64  `json:"deltatotal"`
+	DeltaCor          *int64 `json:"deltacor,omitempty"`
+	DeltaPB           *int64 `json:"deltapb,omitempty"`
+	IntervaloSegundos int64  `json:"intervalosegundos"`  // Desde a leitura anterior; 0 na primeira
+	Reinicio          bool   `json:"reinicio,omitempty"` // Contador menor que o anterior (troca de placa, reset)
+	Setor             string `json:"setor"`
+	IP                string `json:"ip"`
+	MAC               string `json:"mac"`
+	IDEmpresa         int    `json:"empresa"`
+}
+
+// snmpPoller liga a configuração de uma impressora ao cliente SNMP dela. O cliente é mantido
+// entre as leituras para reaproveitar o estado do SNMPv3 (engineID e chaves).
+type snmpPoller struct {
+	cfg    *SNMPPrinterConfig
+	client *snmpClient
+}
+
+func (p *snmpPoller) name() string {
+	return firstNonEmpty(p.cfg.Name, p.cfg.Address)
+}
+
+// newSNMPPollers cria um poller para cada entrada de cfg.SNMPPrinters. Entradas inválidas são
+// logadas e ignoradas, como as fontes de log.
+func newSNMPPollers(cfg *Config) []*snmpPoller {
+	var pollers []*snmpPoller
+	for i := range cfg.SNMPPrinters {
+		pc := &cfg.SNMPPrinters[i]
+		client, err := newSNMPClient(pc)
+		if err != nil {
+			globalLogger.Println(fmt.Sprintf("ERROR: Ignoring SNMP printer %d ('%s'): %v", i, pc.Address, err))
+			continue
+		}
+		pollers = append(pollers, &snmpPoller{cfg: pc, client: client})
+	}
+	return pollers
+}
+
+// runSNMPPoller lê os contadores da impressora a cada intervalo até stop ser fechado.
+func runSNMPPoller(cfg *Config, poller *snmpPoller, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	run := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				globalLogger.Println(fmt.Sprintf("CRITICAL: Panic while polling SNMP printer %s: %v", poller.name(), r))
+			}
+		}()
+		if err := pollPrinterCounters(cfg, poller); err != nil {
+			globalLogger.Println(fmt.Sprintf("ERROR during SNMP polling (%s): %v", poller.name(), err))
+			if snmpNeedsRediscovery(err) {
+				poller.client.engineID = nil // Força nova descoberta SNMPv3 (agente pode ter reiniciado)
+			}
+		}
+	}
+
+	interval := time.Duration(poller.cfg.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = snmpDefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	run()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			run()
+		}
+	}
+}
+
+// pollPrinterCounters lê os contadores, calcula os deltas e envia o snapshot para a API.
+func pollPrinterCounters(cfg *Config, poller *snmpPoller) error {
+	client := poller.client
+	markers, err := client.walk(oidPrtMarkerLifeCount)
+	if err != nil {
+		return fmt.Errorf("failed to read prtMarkerLifeCount: %w", err)
+	}
+	var total int64
+	found := false
+	for _, marker := range markers {
+		if count, ok := marker.int64Value(); ok {
+			total += count
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("printer does not expose prtMarkerLifeCount (%s)", oidPrtMarkerLifeCount)
+	}
+
+	now := time.Now()
+	snapshot := CounterSnapshot{
+		Impressora:   poller.name(),
+		Endereco:     poller.cfg.Address,
+		Timestamp:    now.Format(time.RFC3339),
+		TotalPaginas: total,
+		Setor:        poller.cfg.Setor,
+		IDEmpresa:    poller.cfg.IDEmpresa,
+	}
+	if binds, err := client.get(oidPrtGeneralSerialNumber); err == nil && binds[0].exists() {
+		snapshot.NumeroSerie = string(binds[0].value)
+	}
+	if snapshot.PaginasCor, err = readSNMPCounter(client, poller.cfg.ColorOID); err != nil {
+		return fmt.Errorf("failed to read color counter '%s': %w", poller.cfg.ColorOID, err)
+	}
+	if snapshot.PaginasPB, err = readSNMPCounter(client, poller.cfg.MonoOID); err != nil {
+		return fmt.Errorf("failed to read mono counter '%s': %w", poller.cfg.MonoOID, err)
+	}
+
+	if previous, ok := counters.Get(poller.cfg.Address); ok {
+		if at, err := time.Parse(time.RFC3339, previous.Timestamp); err == nil {
+			snapshot.IntervaloSegundos = int64(now.Sub(at).Seconds())
+		}
+		var reset bool
+		snapshot.DeltaTotal, reset = counterDelta(snapshot.TotalPaginas, previous.TotalPaginas)
+		snapshot.Reinicio = reset
+		if snapshot.PaginasCor != nil && previous.PaginasCor != nil {
+			delta, reset := counterDelta(*snapshot.PaginasCor, *previous.PaginasCor)
+			snapshot.DeltaCor = &delta
+			snapshot.Reinicio = snapshot.Reinicio || reset
+		}
+		if snapshot.PaginasPB != nil && previous.PaginasPB != nil {
+			delta, reset := counterDelta(*snapshot.PaginasPB, *previous.PaginasPB)
+			snapshot.DeltaPB = &delta
+			snapshot.Reinicio = snapshot.Reinicio || reset
+		}
+	}
+
+	ip, mac, err := getNetworkInfo()
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not get network info: %v. IP and MAC will be empty.", err))
+	}
+	snapshot.IP, snapshot.MAC = ip, mac
+
+	sendURL := apiEndpoints.Current() + "/central/receptprintercounters"
+	if err := sendDataToAPI(sendURL, snapshot, ""); err != nil {
+		return fmt.Errorf("failed to send counters (delta will be included in the next poll): %w", err)
+	}
+	globalLogger.Println(fmt.Sprintf("SNMP counters for %s: total %d (+%d in %ds).", poller.name(), snapshot.TotalPaginas, snapshot.DeltaTotal, snapshot.IntervaloSegundos))
+	if err := counters.Set(poller.cfg.Address, snapshot); err != nil {
+		return fmt.Errorf("failed to persist counters: %w", err)
+	}
+	return nil
+}
+
+// readSNMPCounter lê um contador opcional; nil quando o OID não está configurado.
+func readSNMPCounter(client *snmpClient, oid string) (*int64, error) {
+	if oid == "" {
+		return nil, nil
+	}
+	binds, err := client.get(oid)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := binds[0].int64Value()
+	if !ok {
+		return nil, fmt.Errorf("OID is missing or not a counter")
+	}
+	return &value, nil
+}
+
+// counterDelta calcula o incremento de um contador. Um valor menor que o anterior indica que o
+// contador foi zerado: o delta é 0 e a leitura passa a ser a nova base.
+func counterDelta(current, previous int64) (int64, bool) {
+	if current < previous {
+		return 0, true
+	}
+	return current - previous, false
+}
+
+// counterStore guarda, por endereço, a última leitura aceita pela API.
+type counterStore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]CounterSnapshot
+}
+
+var counters *counterStore
+
+// setupCounterStore carrega o arquivo de contadores ao lado do arquivo de checkpoints.
+func setupCounterStore() error {
+	path := filepath.Join(os.Getenv("PROGRAMDATA"), "PrintWatchServiceLogs", "snmp-counters.json")
+	store := &counterStore{path: path, entries: make(map[string]CounterSnapshot)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read counter file '%s': %w", path, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &store.entries); err != nil {
+			return fmt.Errorf("failed to parse counter file '%s': %w", path, err)
+		}
+	}
+	counters = store
+	globalLogger.Println(fmt.Sprintf("SNMP counter store loaded from '%s' with %d printer(s).", path, len(store.entries)))
+	return nil
+}
+
+// Get retorna a última leitura aceita da impressora, se houver.
+func (s *counterStore) Get(address string) (CounterSnapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot, found := s.entries[address]
+	return snapshot, found
+}
+
+// Set registra a leitura aceita e grava o store em disco.
+func (s *counterStore) Set(address string, snapshot CounterSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[address] = snapshot
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal counters: %w", err)
+	}
+	return writeFileAtomic(s.path, data, 0644)
+}
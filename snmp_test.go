@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"testing"
+)
+
+// Vetores do RFC 3414, apêndice A.3: senha "maplesyrup" e engineID 00...02.
+func TestSNMPKeyLocalization(t *testing.T) {
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	tests := []struct {
+		name      string
+		newHash   func() hash.Hash
+		key       string
+		localized string
+	}{
+		{
+			name:      "MD5 (A.3.1)",
+			newHash:   md5.New,
+			key:       "9faf3283884e92834ebc9847d8edd963",
+			localized: "526f5eed9fcce26f8964c2930787d82b",
+		},
+		{
+			name:      "SHA (A.3.2)",
+			newHash:   sha1.New,
+			key:       "9fb5cc0381497b3793528939ff788d5d79145211",
+			localized: "6695febc9288e36282235fc7151f128497b38f3f",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(passwordToKey(tt.newHash, "maplesyrup")); got != tt.key {
+				t.Errorf("passwordToKey = %s, want %s", got, tt.key)
+			}
+			if got := hex.EncodeToString(localizeKey(tt.newHash, "maplesyrup", engineID)); got != tt.localized {
+				t.Errorf("localizeKey = %s, want %s", got, tt.localized)
+			}
+		})
+	}
+}
+
+func TestSNMPBEREncodeDecode(t *testing.T) {
+	oids := []string{"1.3.6.1.2.1.43.10.2.1.4.1.1", "1.3.6.1.4.1.11.2.3.9.4.2.1.4.1.2.7.0", "1.3.6.1.2.1.43.5.1.1.17.1"}
+	for _, oid := range oids {
+		encoded, err := berEncodeOID(oid)
+		if err != nil {
+			t.Fatalf("berEncodeOID(%s): %v", oid, err)
+		}
+		_, content, _, err := berRead(encoded)
+		if err != nil || berDecodeOID(content) != oid {
+			t.Errorf("OID %s decoded as %s (%v)", oid, berDecodeOID(content), err)
+		}
+	}
+
+	for _, v := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 2147483647} {
+		_, content, _, err := berRead(berInt(v))
+		if err != nil {
+			t.Fatalf("berInt(%d): %v", v, err)
+		}
+		if got, ok := (snmpVarBind{tag: berInteger, value: content}).int64Value(); !ok || got != v {
+			t.Errorf("berInt(%d) decoded as %d (%v)", v, got, ok)
+		}
+	}
+
+	// GetResponse v2c com Counter32, Counter64 (acima de 32 bits) e noSuchObject
+	bind := func(oid string, value []byte) []byte {
+		encoded, _ := berEncodeOID(oid)
+		return berTLV(berSequence, berConcat(encoded, value))
+	}
+	binds := berConcat(
+		bind(oids[0], berTLV(snmpCounter32, []byte{0x00, 0xff, 0xff, 0xff, 0xff})),
+		bind(oids[1], berTLV(snmpCounter64, []byte{0x01, 0x00, 0x00, 0x00, 0x02})),
+		bind(oids[2], berTLV(snmpNoSuchObj, nil)),
+	)
+	pdu := berTLV(snmpPDUResponse, berConcat(berInt(4242), berInt(0), berInt(0), berTLV(berSequence, binds)))
+	msg := berTLV(berSequence, berConcat(berInt(1), berTLV(berOctetString, []byte("public")), pdu))
+
+	client := &snmpClient{cfg: &SNMPPrinterConfig{Version: snmpVersion2c}, addr: "printer:161"}
+	pduType, requestID, errStatus, _, got, err := client.unwrap(msg)
+	if err != nil {
+		t.Fatalf("unwrap: %v", err)
+	}
+	if pduType != snmpPDUResponse || requestID != 4242 || errStatus != 0 || len(got) != 3 {
+		t.Fatalf("got type 0x%02x id %d status %d with %d varbind(s)", pduType, requestID, errStatus, len(got))
+	}
+	want := []struct {
+		value  int64
+		exists bool
+	}{{4294967295, true}, {4294967298, true}, {0, false}}
+	for i, w := range want {
+		if got[i].oid != oids[i] {
+			t.Errorf("varbind %d: oid %s, want %s", i, got[i].oid, oids[i])
+		}
+		value, ok := got[i].int64Value()
+		if got[i].exists() != w.exists || ok != w.exists || value != w.value {
+			t.Errorf("varbind %d: value %d (%v), exists %v, want %d, %v", i, value, ok, got[i].exists(), w.value, w.exists)
+		}
+	}
+}
+
+// Uma mensagem montada por wrap precisa passar pela verificação de unwrap: HMAC gravado no
+// lugar de msgAuthenticationParameters e scopedPDU cifrada com o salt enviado.
+func TestSNMPv3WrapUnwrap(t *testing.T) {
+	engineID, _ := hex.DecodeString("80001f8880e9630000d61ff449")
+	for _, auth := range []string{"MD5", "SHA", "SHA256"} {
+		for _, priv := range []string{"", "DES", "AES"} {
+			t.Run(auth+"/"+firstNonEmpty(priv, "noPriv"), func(t *testing.T) {
+				cfg := &SNMPPrinterConfig{Version: snmpVersion3, User: "pw", AuthProtocol: auth, AuthPassword: "maplesyrup", PrivProtocol: priv, PrivPassword: "pancakes1"}
+				client, err := newSNMPClient(cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				newHash, _ := snmpAuthHash(auth)
+				client.engineID, client.engineBoot, client.engineTime = engineID, 7, 1000
+				client.authKey = localizeKey(newHash, cfg.AuthPassword, engineID)
+				if priv != "" {
+					client.privKey = localizeKey(newHash, cfg.PrivPassword, engineID)
+				}
+
+				pdu, _ := encodeSNMPPDU(snmpPDUGet, 99, []string{oidPrtGeneralSerialNumber})
+				msg, err := client.wrap(pdu, 99, false)
+				if err != nil {
+					t.Fatalf("wrap: %v", err)
+				}
+				if priv != "" && bytes.Contains(msg, pdu) {
+					t.Error("PDU was sent in clear text")
+				}
+				pduType, requestID, _, _, binds, err := client.unwrap(msg)
+				if err != nil {
+					t.Fatalf("unwrap: %v", err)
+				}
+				if pduType != snmpPDUGet || requestID != 99 || len(binds) != 1 || binds[0].oid != oidPrtGeneralSerialNumber {
+					t.Errorf("got type 0x%02x id %d binds %+v", pduType, requestID, binds)
+				}
+
+				// Um byte alterado invalida o HMAC
+				msg[len(msg)-1] ^= 0xff
+				if _, _, _, _, _, err := client.unwrap(msg); err == nil {
+					t.Error("tampered message was accepted")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // Base de fusos embutida: o Windows não traz o zoneinfo que o Go usa
+)
+
+// Tipos de fonte aceitos em Config.SourceType.
+const (
+	sourceTypePrintLogger = "printlogger" // PaperCut Print Logger (padrão)
+	sourceTypeNGMF        = "ngmf"        // Log de jobs exportado pelo PaperCut NG/MF
+	sourceTypeCUPS        = "cups"        // page_log de um servidor CUPS
+	sourceTypeEventXML    = "eventxml"    // Eventos 307 do PrintService exportados em XML
+)
+
+// finalizeGracePeriod é quanto tempo depois da meia-noite o arquivo do dia anterior ainda é
+// lido como aberto: o logger pode terminar de gravar a última linha de ontem já no dia novo.
+const finalizeGracePeriod = 10 * time.Minute
+
+// catchUpMissing guarda os arquivos diários ausentes já informados no log, para que a
+// recuperação não repita o aviso a cada ciclo.
+var catchUpMissing sync.Map
+
+// LogSource é uma fonte de registros de impressão baseada em arquivos de log diários.
+// Cada implementação conhece o nome dos arquivos e o formato dos registros; o controle de
+// offsets, checkpoints e o envio para a API são comuns a todas.
+type LogSource interface {
+	// Name identifica a fonte nos logs do serviço.
+	Name() string
+	// Dir é o diretório monitorado pela fonte.
+	Dir() string
+	// DailyFile retorna o caminho do arquivo de log do dia.
+	DailyFile(day time.Time) string
+	// FileDay extrai o dia a partir do caminho de um arquivo desta fonte.
+	FileDay(path string) (time.Time, bool)
+	// Read lê os registros completos de file a partir de offset, chamando emit para cada
+	// PrintData e commit com o offset logo após cada registro tratado. final indica que o
+	// arquivo não recebe mais escrita. Retorna o último offset confirmado.
+	Read(file *os.File, offset int64, final bool, emit func(PrintData), commit func(offset int64) error) (int64, error)
+}
+
+// configuredSource liga uma fonte à configuração de onde ela foi criada.
+type configuredSource struct {
+	cfg *SourceConfig
+	src LogSource
+}
+
+// newLogSources cria uma LogSource para cada entrada de cfg.Sources. Entradas inválidas são
+// logadas e ignoradas, para que uma fonte mal configurada não derrube as outras.
+func newLogSources(cfg *Config) []configuredSource {
+	var sources []configuredSource
+	for i := range cfg.Sources {
+		sc := &cfg.Sources[i]
+		src, err := newLogSource(sc)
+		if err != nil {
+			globalLogger.Println(fmt.Sprintf("ERROR: Ignoring log source %d ('%s'): %v", i, sc.PapercutLogDir, err))
+			continue
+		}
+		sources = append(sources, configuredSource{cfg: sc, src: src})
+	}
+	return sources
+}
+
+// newLogSource cria a fonte configurada em cfg.SourceType.
+func newLogSource(cfg *SourceConfig) (LogSource, error) {
+	switch strings.ToLower(cfg.SourceType) {
+	case "", sourceTypePrintLogger:
+		return newCSVLogSource(cfg, printLoggerSchema)
+	case sourceTypeNGMF:
+		return newCSVLogSource(cfg, ngmfSchema)
+	case sourceTypeCUPS:
+		return newCUPSLogSource(cfg)
+	case sourceTypeEventXML:
+		return newEventXMLLogSource(cfg)
+	}
+	return nil, fmt.Errorf("unknown sourceType '%s' (expected '%s', '%s', '%s' or '%s')", cfg.SourceType, sourceTypePrintLogger, sourceTypeNGMF, sourceTypeCUPS, sourceTypeEventXML)
+}
+
+// runLogSource processa uma fonte imediatamente e depois a cada PollingInterval, até stop ser
+// fechado. Erros e panics ficam restritos à fonte e são apenas logados.
+func runLogSource(cfg *Config, source configuredSource, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	run := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				globalLogger.Println(fmt.Sprintf("CRITICAL: Panic while processing %s logs: %v", source.src.Name(), r))
+			}
+		}()
+		globalLogger.Println(fmt.Sprintf("PrintWatch: Executando tarefa de monitoramento de logs (%s)...", source.src.Name()))
+		if err := processLogSource(cfg, source.src); err != nil {
+			globalLogger.Println(fmt.Sprintf("ERROR during log processing (%s): %v", source.src.Name(), err))
+			elog.Warning(1, fmt.Sprintf("Error processing logs (%s): %v", source.src.Name(), err))
+		}
+	}
+
+	pollingInterval := time.Duration(source.cfg.PollingInterval) * time.Second
+	if pollingInterval <= 0 {
+		pollingInterval = 10 * time.Second
+	}
+	ticker := time.NewTicker(pollingInterval)
+	defer ticker.Stop()
+
+	run()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			run()
+		}
+	}
+}
+
+// waitSources espera as goroutines das fontes terminarem, por no máximo timeout.
+func waitSources(wg *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		globalLogger.Println("WARNING: Timed out waiting for log sources to stop.")
+	}
+}
+
+// processLogSource lê novas linhas do log e as envia para a API.
+// Antes do arquivo de hoje, drena em ordem de data os arquivos diários desde o dia mais antigo
+// ainda não finalizado (catchUpStartDay), cobrindo a virada da meia-noite e períodos em que o
+// serviço ficou parado. Um dia anterior só deixa de ser drenado depois de lido como final.
+func processLogSource(cfg *Config, src LogSource) error {
+	now := time.Now()
+	today := startOfDay(now)
+
+	startDay, found := catchUpStartDay(src)
+	if found && startDay.Before(today) {
+		for day := startDay; day.Before(today); day = day.AddDate(0, 0, 1) {
+			logPath := src.DailyFile(day)
+			info, err := os.Stat(logPath)
+			if os.IsNotExist(err) {
+				if _, logged := catchUpMissing.LoadOrStore(logPath, true); !logged {
+					globalLogger.Println(fmt.Sprintf("CATCH-UP: No %s log for %s (%s). Skipping day.", src.Name(), day.Format("2006-01-02"), logPath))
+				}
+				continue
+			}
+			// Arquivos de dias anteriores não recebem mais escrita, então a última linha é final;
+			// o de ontem só depois de finalizeGracePeriod, até lá uma linha parcial fica para depois.
+			final := day.AddDate(0, 0, 1).Before(today) || now.Sub(today) >= finalizeGracePeriod
+			if cp, ok := checkpoints.Get(logPath); ok && err == nil && cp.Offset == info.Size() && (cp.Final || !final) {
+				continue // Dia já drenado por completo e, se já pode ser, finalizado
+			}
+			globalLogger.Println(fmt.Sprintf("CATCH-UP: Draining %s log for %s (%s).", src.Name(), day.Format("2006-01-02"), logPath))
+			if err := processLogFile(cfg, src, logPath, final); err != nil {
+				return fmt.Errorf("catch-up of %s stopped: %w", day.Format("2006-01-02"), err)
+			}
+			globalLogger.Println(fmt.Sprintf("CATCH-UP: Finished %s log for %s.", src.Name(), day.Format("2006-01-02")))
+		}
+	}
+
+	// Obtém o caminho do log para o dia atual
+	logPath := src.DailyFile(today)
+	if _, err := os.Stat(logPath); os.IsNotExist(err) {
+		// Se o arquivo do dia ainda não existe, não é um erro fatal, apenas ignora por enquanto.
+		globalLogger.Println(fmt.Sprintf("INFO: %s log file for today (%s) does not exist yet. Skipping this cycle.", src.Name(), logPath))
+		return nil
+	}
+	return processLogFile(cfg, src, logPath, false)
+}
+
+// processLogFile lê, a partir do checkpoint, os registros novos de um arquivo diário.
+// Se final for true, o arquivo não recebe mais escrita e uma última linha sem '\n' é tratada
+// como completa.
+func processLogFile(cfg *Config, src LogSource, logPath string, final bool) error {
+	file, err := os.OpenFile(logPath, os.O_RDONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s log file '%s': %w", src.Name(), logPath, err)
+	}
+	defer file.Close()
+
+	// Obtém o offset persistido para o arquivo de log atual
+	checkpoint, found := checkpoints.Get(logPath)
+	currentOffset := checkpoint.Offset
+	if !found {
+		// Se for a primeira vez que vemos este arquivo, o offset é 0
+		currentOffset = 0
+		globalLogger.Println(fmt.Sprintf("INFO: Starting to read new log file: %s from offset 0", logPath))
+	} else {
+		// Arquivo truncado, reescrito ou restaurado de backup: o offset salvo não aponta mais
+		// para um limite de registro. Relê do início e deixa a verificação de duplicatas da API
+		// descartar o que já foi enviado.
+		reason, err := detectFileReset(file, checkpoint)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			globalLogger.Println(fmt.Sprintf("WARNING: Log file '%s' was %s. Re-reading from offset 0 (previous offset %d).", logPath, reason, currentOffset))
+			currentOffset = 0
+			// Registra o novo estado já, para não repetir o aviso se nada puder ser lido agora.
+			if err := saveFileCheckpoint(file, logPath, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	// O checkpoint avança logo depois de cada registro tratado. Se o registro já está no índice
+	// de jobs confirmados (gravado com fsync), a gravação do checkpoint pode esperar
+	// (checkpointStore.Update): relido depois de uma queda, ele é descartado pelo índice. Um
+	// registro que foi para a fila de pendências ou o dead-letter não está no índice, então o
+	// checkpoint é gravado na hora, para que uma queda não o enfileire de novo. Registros
+	// descartados (cabeçalho, linhas malformadas ou filtradas) só avançam o offset em memória,
+	// gravado uma vez no fim da leitura.
+	delivered := false
+	acknowledged := true
+	pendingOffset := int64(-1)
+	advance := func(offset int64) error {
+		pendingOffset = -1
+		if acknowledged {
+			return updateFileCheckpoint(file, logPath, offset)
+		}
+		acknowledged = true
+		return saveFileCheckpoint(file, logPath, offset)
+	}
+	emit := func(data PrintData) {
+		if !deliverImpression(cfg, data, logPath) {
+			acknowledged = false
+		}
+		delivered = true
+	}
+	commit := func(offset int64) error {
+		if !delivered {
+			pendingOffset = offset
+			return nil
+		}
+		delivered = false
+		return advance(offset)
+	}
+
+	// Em lotes, o checkpoint de um registro só é gravado depois que o lote dele foi entregue ou
+	// enfileirado: uma queda antes disso faz o registro ser relido, nunca perdido.
+	var batch *impressionBatch
+	if batchEnabled(cfg) {
+		batch = newImpressionBatch(cfg, logPath)
+		emit = batch.add
+		commit = func(offset int64) error {
+			pendingOffset = offset
+			if batch.empty() || !batch.due() {
+				return nil
+			}
+			if !batch.flush() {
+				acknowledged = false
+			}
+			return advance(offset)
+		}
+	}
+
+	committedOffset, err := src.Read(file, currentOffset, final, emit, commit)
+	if batch != nil {
+		batch.flush()
+	}
+	if pendingOffset >= 0 {
+		if saveErr := saveFileCheckpoint(file, logPath, pendingOffset); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	} else if flushErr := checkpoints.Flush(); flushErr != nil && err == nil {
+		err = fmt.Errorf("failed to persist checkpoints: %w", flushErr)
+	}
+	if final && err == nil {
+		// Lido como final, o arquivo não volta a ser drenado pela recuperação retroativa.
+		err = finalizeFileCheckpoint(file, logPath, committedOffset)
+	}
+	if committedOffset != currentOffset {
+		globalLogger.Println(fmt.Sprintf("Updated lastReadOffset for '%s' to: %d", logPath, committedOffset))
+	}
+	return err
+}
+
+// deliverImpression tenta enviar a impressão e, se falhar, a coloca na fila de pendências (ou
+// no dead-letter, se a API a recusou de forma definitiva). Retorna o mesmo que settleImpression.
+func deliverImpression(cfg *Config, data PrintData, sourceFile string) bool {
+	return settleImpression(data, tryProcessImpression(cfg, data, sourceFile), sourceFile)
+}
+
+// recordJobID deriva o ID de um registro do arquivo de origem, do offset em que o registro
+// começa e do seu conteúdo. O mesmo registro relido (reinício, backfill, fila de pendências)
+// tem sempre o mesmo ID, enquanto dois jobs idênticos no mesmo segundo ficam em offsets
+// diferentes e têm IDs diferentes.
+func recordJobID(path string, offset int64, content []byte) string {
+	h := sha256.New()
+	h.Write([]byte(strings.ToLower(filepath.Clean(path)))) // Caminhos no Windows não diferenciam maiúsculas
+	h.Write([]byte{0})
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(offset)))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// loadSourceLocation resolve Config.TimeZone (nome IANA, ex: "America/Manaus"). Vazio ou
+// "Local" usa o fuso do servidor.
+func loadSourceLocation(name string) (*time.Location, error) {
+	if name == "" || strings.EqualFold(name, "local") {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeZone '%s': %w", name, err)
+	}
+	return loc, nil
+}
+
+// startOfDay retorna a meia-noite local do dia de t.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
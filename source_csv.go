@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvSchema descreve um formato de log CSV do PaperCut: nome dos arquivos diários, nome das
+// colunas no cabeçalho e como interpretar os valores que mudam entre os produtos.
+type csvSchema struct {
+	name           string
+	fileNameLayout string            // Layout Go do nome do arquivo diário
+	columns        map[string]string // Campo lógico -> nome da coluna no cabeçalho
+	timeLayouts    []string          // Formatos aceitos para a coluna de data/hora
+	colorValue     func(string) string
+}
+
+// printLoggerSchema é o CSV diário do PaperCut Print Logger:
+// Time,User,Pages,Copies,Printer,Document Name,Client,Paper Size,Language,Height,Width,Duplex,Grayscale,Size
+var printLoggerSchema = csvSchema{
+	name:           "PaperCut Print Logger",
+	fileNameLayout: "papercut-print-log-2006-01-02.csv",
+	columns: map[string]string{
+		colTime:         "Time",
+		colUser:         "User",
+		colPages:        "Pages",
+		colCopies:       "Copies",
+		colPrinter:      "Printer",
+		colDocumentName: "Document Name",
+		colClient:       "Client",
+		colPaperSize:    "Paper Size",
+		colGrayscale:    "Grayscale",
+		colSize:         "Size",
+	},
+	timeLayouts: []string{"2006-01-02 15:04:05"},
+	colorValue:  strings.TrimSpace, // Mantém o valor original (ex: "GRAYSCALE")
+}
+
+// ngmfSchema é o log de jobs exportado pelo PaperCut NG/MF. O nome dos arquivos, as colunas e
+// o formato de data/hora dependem de como a exportação foi configurada, então não há padrão:
+// fileNameLayout, timeLayouts e as colunas obrigatórias de columnMap precisam ser informados.
+var ngmfSchema = csvSchema{
+	name:       "PaperCut NG/MF",
+	colorValue: ngmfColorValue,
+}
+
+// ngmfColorValue converte o Yes/No do NG/MF para os valores usados pelo Print Logger,
+// para que a API receba o mesmo vocabulário das duas fontes.
+func ngmfColorValue(value string) string {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "y", "true", "1", "grayscale":
+		return "GRAYSCALE"
+	case "no", "n", "false", "0", "not grayscale":
+		return "NOT GRAYSCALE"
+	}
+	return strings.TrimSpace(value)
+}
+
+// csvLogSource lê os arquivos CSV diários de um produto PaperCut.
+type csvLogSource struct {
+	cfg            *SourceConfig
+	schema         csvSchema
+	fileNameLayout string
+	delimiters     []rune
+	timeLayouts    []string
+	location       *time.Location // Fuso horário em que o PaperCut grava os horários
+}
+
+// newCSVLogSource cria a fonte CSV aplicando as opções de Config sobre o schema: nome dos
+// arquivos, delimitador e formatos de data/hora.
+func newCSVLogSource(cfg *SourceConfig, schema csvSchema) (*csvLogSource, error) {
+	src := &csvLogSource{
+		cfg:            cfg,
+		schema:         schema,
+		fileNameLayout: schema.fileNameLayout,
+		timeLayouts:    schema.timeLayouts,
+	}
+	if cfg.FileNameLayout != "" {
+		src.fileNameLayout = cfg.FileNameLayout
+	}
+	if len(cfg.TimeLayouts) > 0 {
+		src.timeLayouts = make([]string, len(cfg.TimeLayouts))
+		for i, layout := range cfg.TimeLayouts {
+			src.timeLayouts[i] = toGoTimeLayout(layout)
+		}
+	}
+
+	location, err := loadSourceLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	src.location = location
+
+	delimiters, err := parseDelimiters(cfg.Delimiter)
+	if err != nil {
+		return nil, err
+	}
+	src.delimiters = delimiters
+
+	if _, _, err := parseEncodingName(cfg.Encoding); err != nil {
+		return nil, err
+	}
+
+	// Schemas sem padrão (NG/MF) dependem da configuração
+	if src.fileNameLayout == "" {
+		return nil, fmt.Errorf("fileNameLayout is required for %s logs", schema.name)
+	}
+	if len(src.timeLayouts) == 0 {
+		return nil, fmt.Errorf("timeLayouts is required for %s logs", schema.name)
+	}
+	var missing []string
+	for _, field := range requiredColumns {
+		if schema.columns[field] == "" && cfg.ColumnMap[field] == "" {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("columnMap must name the %s column(s) for %s logs", strings.Join(missing, ", "), schema.name)
+	}
+	return src, nil
+}
+
+func (s *csvLogSource) Name() string {
+	if s.cfg.Name != "" {
+		return s.cfg.Name
+	}
+	return s.schema.name
+}
+
+func (s *csvLogSource) Dir() string {
+	return s.cfg.PapercutLogDir
+}
+
+// DailyFile constrói o caminho completo para o arquivo de log do dia.
+func (s *csvLogSource) DailyFile(day time.Time) string {
+	return filepath.Join(s.cfg.PapercutLogDir, day.Format(s.fileNameLayout))
+}
+
+// FileDay extrai a data do nome de um arquivo diário.
+func (s *csvLogSource) FileDay(path string) (time.Time, bool) {
+	day, err := time.ParseInLocation(s.fileNameLayout, filepath.Base(path), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return startOfDay(day), true
+}
+
+// Read processa os registros de file a partir de currentOffset.
+func (s *csvLogSource) Read(file *os.File, currentOffset int64, final bool, emit func(PrintData), commit func(offset int64) error) (int64, error) {
+	logPath := file.Name()
+
+	// Lê apenas até o tamanho atual do arquivo. O que o PaperCut escrever depois disso fica
+	// para o próximo ciclo, o que permite saber se a última linha já está completa.
+	info, err := file.Stat()
+	if err != nil {
+		return currentOffset, fmt.Errorf("failed to stat log file '%s': %w", logPath, err)
+	}
+	fileSize := info.Size()
+	if currentOffset >= fileSize {
+		return currentOffset, nil // Nada novo desde o último ciclo
+	}
+	// Codificação (pelo BOM ou pela configuração) e separador são resolvidos antes de qualquer
+	// registro virar PrintData; os offsets continuam sempre em bytes do arquivo original.
+	enc, bomLen, err := detectEncoding(file, s.cfg.Encoding)
+	if err != nil {
+		return currentOffset, err
+	}
+
+	// O cabeçalho é sempre lido do início do arquivo, mesmo ao retomar de um checkpoint,
+	// para que as colunas sejam localizadas pelo nome e não por posição fixa.
+	header, err := readCSVHeader(file, fileSize, enc, bomLen, final, s.delimiters, s.schema.columns, s.cfg.ColumnMap)
+	if err == errHeaderIncomplete {
+		globalLogger.Println(fmt.Sprintf("INFO: CSV header in '%s' is still being written. Will retry next cycle.", logPath))
+		return currentOffset, nil
+	}
+	if err != nil {
+		return currentOffset, fmt.Errorf("failed to map CSV columns of '%s': %w", logPath, err)
+	}
+	if currentOffset < header.end {
+		// Novo arquivo ou primeira leitura: os dados começam logo após o cabeçalho.
+		if err := commit(header.end); err != nil {
+			return currentOffset, err
+		}
+		currentOffset = header.end
+		if currentOffset >= fileSize {
+			return currentOffset, nil
+		}
+	}
+
+	section, err := newDecodedSection(file, enc, currentOffset, fileSize, '\n')
+	if err != nil {
+		return currentOffset, err
+	}
+	reader := newLogCSVReader(section.reader, header.comma)
+
+	// recordEnd retorna o offset absoluto logo após o último registro lido e se esse registro
+	// está completo (terminado por quebra de linha). Um registro que termina exatamente no fim
+	// do arquivo sem '\n' ainda está sendo escrito pelo PaperCut (exceto em arquivos finais).
+	recordEnd := func() (int64, bool) {
+		pos := reader.InputOffset()
+		return section.rawOffset(pos), pos < section.size || section.endsWithNewline || final
+	}
+
+	// Processar linhas uma por uma. O offset só avança depois que um registro completo foi
+	// tratado (enviado, enfileirado ou descartado por estar malformado).
+	committedOffset := currentOffset
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break // Fim do arquivo
+		}
+		nextOffset, complete := recordEnd()
+		if !complete {
+			// Linha parcial: não avança o offset, ela será lida inteira no próximo ciclo
+			globalLogger.Println(fmt.Sprintf("INFO: Last line of '%s' at offset %d is incomplete. Leaving it for the next cycle.", logPath, committedOffset))
+			break
+		}
+
+		if err != nil {
+			globalLogger.Println(fmt.Sprintf("WARNING: Failed to read CSV record from '%s', skipping: %v", logPath, err))
+		} else if printData, ok := s.parseRecord(header.cols, record, logPath); ok {
+			printData.JobID = recordJobID(logPath, committedOffset, []byte(strings.Join(record, "\x1f")))
+			emit(printData)
+		}
+
+		if err := commit(nextOffset); err != nil {
+			return committedOffset, err
+		}
+		committedOffset = nextOffset
+	}
+
+	return committedOffset, nil
+}
+
+// parseRecord converte uma linha do CSV em PrintData, localizando cada campo pelo mapa de
+// colunas do cabeçalho. Retorna false se o registro deve ser descartado.
+func (s *csvLogSource) parseRecord(cols columnIndex, record []string, sourceFile string) (PrintData, bool) {
+	// Garante que o registro tenha todas as colunas obrigatórias
+	if !cols.hasRequired(record) {
+		globalLogger.Println(fmt.Sprintf("WARNING: Skipping malformed record (not enough columns) from '%s': %v", sourceFile, record))
+		return PrintData{}, false
+	}
+
+	// --- Montar a estrutura de dados para a API com os novos campos ---
+	timeStr := cols.get(record, colTime)
+	parsedTime, err := parseTimeLayouts(s.timeLayouts, timeStr, s.location)
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not parse timestamp '%s', skipping record: %v", timeStr, err))
+		return PrintData{}, false
+	}
+
+	pagesStr := cols.get(record, colPages)
+	paginas, err := strconv.Atoi(pagesStr) // Coluna "Pages"
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not parse pages '%s' to int, using 0: %v", pagesStr, err))
+		paginas = 0 // Define 0 se a conversão falhar
+	}
+
+	copiesStr := cols.get(record, colCopies)
+	copias, err := strconv.Atoi(copiesStr) // Coluna "Copies"
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not parse copies '%s' to int, using 1: %v", copiesStr, err))
+		copias = 1 // Define 1 se a conversão falhar
+	}
+
+	// O campo "tipo" é a extensão do arquivo
+	documentName := cols.get(record, colDocumentName)
+	fileExtension := strings.TrimPrefix(filepath.Ext(documentName), ".")
+
+	// --- Capturar informações de rede ---
+	ip, mac, err := getNetworkInfo()
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not get network info: %v. IP and MAC will be empty.", err))
+	}
+
+	printData := PrintData{
+		Data:        parsedTime.Format("2006-01-02"),
+		Hora:        parsedTime.Format("15:04:05"),
+		Timestamp:   parsedTime.Format(time.RFC3339),
+		Usuario:     cols.get(record, colUser), // "User"
+		Setor:       s.cfg.Setor,
+		Paginas:     paginas,
+		Copias:      copias,
+		Impressora:  cols.get(record, colPrinter),                        // "Printer"
+		NomeArquivo: documentName,                                        // "Document Name"
+		Tipo:        fileExtension,                                       // Extensão do arquivo (ex: "pdf")
+		NomePC:      cols.get(record, colClient),                         // "Client"
+		TipoPage:    cols.get(record, colPaperSize),                      // "Paper Size"
+		Cor:         s.schema.colorValue(cols.get(record, colGrayscale)), // Ex: "GRAYSCALE"
+		Tamanho:     cols.get(record, colSize),                           // "Size"
+		IP:          ip,                                                  // Capturado localmente
+		MAC:         mac,                                                 // Capturado localmente
+		IDEmpresa:   s.cfg.IDEmpresa,
+	}
+
+	return printData, true
+}
+
+// toGoTimeLayout aceita formatos no estilo "dd/MM/yyyy HH:mm:ss" além do layout nativo do Go
+// ("02/01/2006 15:04:05"), que é devolvido sem alteração.
+func toGoTimeLayout(pattern string) string {
+	if strings.Contains(pattern, "2006") {
+		return pattern
+	}
+	replacer := strings.NewReplacer(
+		"yyyy", "2006",
+		"yy", "06",
+		"MM", "01",
+		"dd", "02",
+		"HH", "15",
+		"hh", "03",
+		"mm", "04",
+		"ss", "05",
+		"tt", "PM",
+	)
+	return replacer.Replace(pattern)
+}
+
+// parseTimeLayouts tenta cada layout até um deles aceitar value, interpretando o horário de
+// parede no fuso loc.
+func parseTimeLayouts(layouts []string, value string, loc *time.Location) (time.Time, error) {
+	var lastErr error
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err == nil {
+			return t, nil
+		}
+		lastErr = err
+	}
+	return time.Time{}, lastErr
+}
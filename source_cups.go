@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cupsDefaultPageLogFormat é o PageLogFormat padrão do CUPS (cupsd.conf).
+const cupsDefaultPageLogFormat = "%p %u %j %T %P %C %{job-billing} %{job-originating-host-name} %{job-name} %{media} %{sides}"
+
+// cupsTimeLayout é o formato de %T no page_log, ex: "[21/Jan/2026:10:15:30 -0300]".
+const cupsTimeLayout = "[02/Jan/2006:15:04:05 -0700]"
+
+// cupsJobIdleTimeout é quanto tempo sem novas páginas encerra um job que não recebeu a linha
+// "total" nem foi seguido por outro job na mesma impressora.
+const cupsJobIdleTimeout = 2 * time.Minute
+
+// pageLogField é um item do PageLogFormat: uma diretiva (%p, %{job-name}...) ou um texto literal.
+type pageLogField struct {
+	directive string // "p", "u", "j", "T", "P", "C" ou o nome do atributo de %{...}
+	literal   string
+}
+
+// cupsPage é uma linha do page_log já interpretada.
+type cupsPage struct {
+	printer string
+	user    string
+	jobID   string
+	time    time.Time
+	page    string // Número da página ou "total"
+	copies  int
+	attrs   map[string]string
+}
+
+// cupsJob agrupa as linhas de um mesmo job.
+type cupsJob struct {
+	key      string
+	start    int64 // Offset da primeira linha do job
+	first    cupsPage
+	last     time.Time
+	pages    map[string]bool
+	total    int // Páginas informadas pela linha "total", se houver
+	copies   int
+	closed   bool
+	lastAttr map[string]string
+}
+
+// cupsLogSource lê o page_log do CUPS, agrupando as linhas por página em jobs.
+type cupsLogSource struct {
+	cfg      *SourceConfig
+	fields   []pageLogField
+	location *time.Location
+	// emitted guarda os jobs já enviados que ainda estão depois do offset confirmado, para
+	// não reenviá-los enquanto um job anterior continua aberto.
+	emitted map[string]map[string]int64
+}
+
+// newCUPSLogSource cria a fonte do page_log; cfg.PageLogFormat substitui o formato padrão.
+func newCUPSLogSource(cfg *SourceConfig) (*cupsLogSource, error) {
+	format := cfg.PageLogFormat
+	if format == "" {
+		format = cupsDefaultPageLogFormat
+	}
+	fields, err := parsePageLogFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	location, err := loadSourceLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	return &cupsLogSource{
+		cfg:      cfg,
+		fields:   fields,
+		location: location,
+		emitted:  make(map[string]map[string]int64),
+	}, nil
+}
+
+func (s *cupsLogSource) Name() string {
+	if s.cfg.Name != "" {
+		return s.cfg.Name
+	}
+	return "CUPS page_log"
+}
+
+func (s *cupsLogSource) Dir() string {
+	return s.cfg.PapercutLogDir
+}
+
+// DailyFile retorna sempre o mesmo page_log: o CUPS não cria um arquivo por dia.
+func (s *cupsLogSource) DailyFile(day time.Time) string {
+	name := s.cfg.FileNameLayout
+	if name == "" {
+		name = "page_log"
+	}
+	return filepath.Join(s.cfg.PapercutLogDir, name)
+}
+
+// FileDay não se aplica ao page_log; sem data no nome, não há recuperação por dia.
+func (s *cupsLogSource) FileDay(path string) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Read interpreta as linhas completas a partir de currentOffset. Jobs encerrados são emitidos;
+// o offset confirmado para no início do job aberto mais antigo, que é relido no próximo ciclo.
+func (s *cupsLogSource) Read(file *os.File, currentOffset int64, final bool, emit func(PrintData), commit func(offset int64) error) (int64, error) {
+	logPath := file.Name()
+
+	info, err := file.Stat()
+	if err != nil {
+		return currentOffset, fmt.Errorf("failed to stat log file '%s': %w", logPath, err)
+	}
+	fileSize := info.Size()
+	if currentOffset >= fileSize {
+		return currentOffset, nil // Nada novo desde o último ciclo
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, currentOffset, fileSize-currentOffset))
+	pos := currentOffset
+	jobs := make(map[string]*cupsJob)
+	var order []*cupsJob
+	lastJobByPrinter := make(map[string]*cupsJob)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return currentOffset, fmt.Errorf("failed to read '%s': %w", logPath, err)
+		}
+		if line == "" || (err == io.EOF && !final) {
+			break // Fim do arquivo ou linha ainda sendo escrita pelo CUPS
+		}
+		lineStart := pos
+		pos += int64(len(line))
+
+		page, perr := s.parseLine(strings.TrimRight(line, "\r\n"))
+		if perr != nil {
+			globalLogger.Println(fmt.Sprintf("WARNING: Skipping malformed page_log line at offset %d in '%s': %v", lineStart, logPath, perr))
+			continue
+		}
+
+		key := page.printer + "\x00" + page.jobID
+		// O CUPS imprime um job por vez em cada impressora: outro job na mesma fila encerra o anterior
+		if prev := lastJobByPrinter[page.printer]; prev != nil && prev.key != key {
+			prev.closed = true
+		}
+		job := jobs[key]
+		if job == nil {
+			job = &cupsJob{key: key, start: lineStart, first: page, pages: make(map[string]bool), copies: 1}
+			jobs[key] = job
+			order = append(order, job)
+		}
+		job.last = page.time
+		job.lastAttr = page.attrs
+		if page.copies > job.copies {
+			job.copies = page.copies
+		}
+		if page.page == "total" {
+			// Na linha "total", o campo de cópias traz o total de páginas do job
+			job.total = page.copies
+			job.copies = 1
+			job.closed = true
+		} else {
+			job.pages[page.page] = true
+		}
+		lastJobByPrinter[page.printer] = job
+	}
+
+	now := time.Now()
+	emitted := s.emitted[logPath]
+	if emitted == nil {
+		emitted = make(map[string]int64)
+		s.emitted[logPath] = emitted
+	}
+
+	commitOffset := pos
+	for _, job := range order {
+		if !job.closed && (final || now.Sub(job.last) > cupsJobIdleTimeout) {
+			job.closed = true
+		}
+		if !job.closed {
+			if job.start < commitOffset {
+				commitOffset = job.start
+			}
+			continue
+		}
+		if start, done := emitted[job.key]; done && start == job.start {
+			continue
+		}
+		printData := s.buildPrintData(job)
+		printData.JobID = recordJobID(logPath, job.start, []byte(job.key))
+		emit(printData)
+		emitted[job.key] = job.start
+	}
+
+	// Jobs antes do offset confirmado não serão relidos; não precisam mais ser lembrados
+	for key, start := range emitted {
+		if start < commitOffset {
+			delete(emitted, key)
+		}
+	}
+
+	if commitOffset == currentOffset {
+		return currentOffset, nil
+	}
+	if err := commit(commitOffset); err != nil {
+		return currentOffset, err
+	}
+	return commitOffset, nil
+}
+
+// buildPrintData converte um job agrupado em PrintData.
+func (s *cupsLogSource) buildPrintData(job *cupsJob) PrintData {
+	paginas := job.total
+	if paginas == 0 {
+		paginas = len(job.pages)
+	}
+
+	attr := func(name string) string {
+		if v := job.lastAttr[name]; v != "" && v != "-" {
+			return v
+		}
+		if v := job.first.attrs[name]; v != "-" {
+			return v
+		}
+		return ""
+	}
+	documentName := attr("job-name")
+	fileExtension := strings.TrimPrefix(filepath.Ext(documentName), ".")
+	localTime := job.first.time.In(s.location)
+
+	// --- Capturar informações de rede ---
+	ip, mac, err := getNetworkInfo()
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not get network info: %v. IP and MAC will be empty.", err))
+	}
+
+	return PrintData{
+		Data:        localTime.Format("2006-01-02"),
+		Hora:        localTime.Format("15:04:05"),
+		Timestamp:   localTime.Format(time.RFC3339),
+		Usuario:     job.first.user,
+		Setor:       s.cfg.Setor,
+		Paginas:     paginas,
+		Copias:      job.copies,
+		Impressora:  job.first.printer,
+		NomeArquivo: documentName,
+		Tipo:        fileExtension,
+		NomePC:      attr("job-originating-host-name"),
+		TipoPage:    attr("media"),
+		Cor:         attr("print-color-mode"),
+		IP:          ip,
+		MAC:         mac,
+		IDEmpresa:   s.cfg.IDEmpresa,
+	}
+}
+
+// parseLine interpreta uma linha conforme o PageLogFormat. Os valores são separados por
+// espaço; o único campo que pode conter espaços é %{job-name}, que absorve os tokens excedentes.
+func (s *cupsLogSource) parseLine(line string) (cupsPage, error) {
+	tokens := tokenizePageLogLine(line)
+	if len(tokens) == 0 {
+		return cupsPage{}, fmt.Errorf("empty line")
+	}
+
+	greedy := -1
+	for i, f := range s.fields {
+		if f.directive == "job-name" {
+			greedy = i
+		}
+	}
+	extra := len(tokens) - len(s.fields)
+	if extra > 0 && greedy < 0 {
+		return cupsPage{}, fmt.Errorf("expected %d fields, got %d", len(s.fields), len(tokens))
+	}
+
+	page := cupsPage{copies: 1, attrs: make(map[string]string)}
+	t := 0
+	for i, f := range s.fields {
+		if t >= len(tokens) {
+			break // Versões antigas do CUPS registram menos atributos no fim da linha
+		}
+		value := tokens[t]
+		t++
+		if i == greedy && extra > 0 {
+			value = strings.Join(tokens[t-1:t+extra], " ")
+			t += extra
+		}
+
+		switch f.directive {
+		case "":
+			if value != f.literal {
+				return cupsPage{}, fmt.Errorf("expected '%s', got '%s'", f.literal, value)
+			}
+		case "p":
+			page.printer = value
+		case "u":
+			page.user = value
+		case "j":
+			page.jobID = value
+		case "T":
+			parsed, err := time.Parse(cupsTimeLayout, value)
+			if err != nil {
+				return cupsPage{}, fmt.Errorf("invalid time '%s': %w", value, err)
+			}
+			page.time = parsed
+		case "P":
+			page.page = value
+		case "C":
+			copies, err := strconv.Atoi(value)
+			if err != nil {
+				return cupsPage{}, fmt.Errorf("invalid copies '%s': %w", value, err)
+			}
+			page.copies = copies
+		default:
+			page.attrs[f.directive] = value
+		}
+	}
+
+	if page.printer == "" || page.jobID == "" || page.page == "" || page.time.IsZero() {
+		return cupsPage{}, fmt.Errorf("missing printer, job id, page or time")
+	}
+	return page, nil
+}
+
+// parsePageLogFormat converte o PageLogFormat em campos separados por espaço.
+func parsePageLogFormat(format string) ([]pageLogField, error) {
+	var fields []pageLogField
+	for _, token := range strings.Fields(format) {
+		switch {
+		case token == "%%":
+			fields = append(fields, pageLogField{literal: "%"})
+		case strings.HasPrefix(token, "%{") && strings.HasSuffix(token, "}"):
+			fields = append(fields, pageLogField{directive: token[2 : len(token)-1]})
+		case len(token) == 2 && token[0] == '%':
+			switch token[1] {
+			case 'p', 'u', 'j', 'T', 'P', 'C':
+				fields = append(fields, pageLogField{directive: token[1:]})
+			default:
+				return nil, fmt.Errorf("unsupported PageLogFormat directive '%s'", token)
+			}
+		case strings.Contains(token, "%"):
+			return nil, fmt.Errorf("unsupported PageLogFormat token '%s' (directives must be separated by spaces)", token)
+		default:
+			fields = append(fields, pageLogField{literal: token})
+		}
+	}
+
+	hasDirective := map[string]bool{}
+	for _, f := range fields {
+		hasDirective[f.directive] = true
+	}
+	for _, required := range []string{"p", "j", "T", "P"} {
+		if !hasDirective[required] {
+			return nil, fmt.Errorf("PageLogFormat '%s' must include %%%s", format, required)
+		}
+	}
+	return fields, nil
+}
+
+// tokenizePageLogLine separa a linha por espaços, mantendo "[data hora fuso]" como um só token.
+func tokenizePageLogLine(line string) []string {
+	var tokens []string
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			break
+		}
+		end := strings.IndexAny(line, " \t")
+		if line[0] == '[' {
+			if closing := strings.IndexByte(line, ']'); closing >= 0 {
+				end = closing + 1
+			}
+		}
+		if end < 0 {
+			end = len(line)
+		}
+		tokens = append(tokens, line[:end])
+		line = line[end:]
+	}
+	return tokens
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventXMLFileNameLayout é o nome padrão dos arquivos exportados, um por dia.
+const eventXMLFileNameLayout = "printservice-2006-01-02.xml"
+
+// printServiceProvider e documentPrintedEventID identificam o evento "documento impresso"
+// do log Microsoft-Windows-PrintService/Operational.
+const (
+	printServiceProvider   = "Microsoft-Windows-PrintService"
+	documentPrintedEventID = 307
+)
+
+var (
+	eventStartTag = []byte("<Event")
+	eventEndTag   = []byte("</Event>")
+)
+
+// eventParam é um parâmetro do evento, tanto em <DocumentPrinted><Param1> quanto em
+// <EventData><Data Name="Param1">.
+type eventParam struct {
+	XMLName xml.Name
+	Name    string `xml:"Name,attr"`
+	Value   string `xml:",chardata"`
+}
+
+// printServiceEvent é o subconjunto do XML de um evento que interessa ao agente.
+type printServiceEvent struct {
+	System struct {
+		Provider struct {
+			Name string `xml:"Name,attr"`
+		} `xml:"Provider"`
+		EventID     int `xml:"EventID"`
+		TimeCreated struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		} `xml:"TimeCreated"`
+		EventRecordID int64 `xml:"EventRecordID"`
+	} `xml:"System"`
+	UserData struct {
+		DocumentPrinted struct {
+			Params []eventParam `xml:",any"`
+		} `xml:"DocumentPrinted"`
+	} `xml:"UserData"`
+	EventData struct {
+		Data []eventParam `xml:"Data"`
+	} `xml:"EventData"`
+}
+
+// param retorna ParamN do evento, seja qual for a forma em que foi exportado.
+func (e *printServiceEvent) param(n int) string {
+	name := "Param" + strconv.Itoa(n)
+	for _, p := range e.UserData.DocumentPrinted.Params {
+		if p.XMLName.Local == name {
+			return strings.TrimSpace(p.Value)
+		}
+	}
+	for _, p := range e.EventData.Data {
+		if p.Name == name {
+			return strings.TrimSpace(p.Value)
+		}
+	}
+	return ""
+}
+
+// eventXMLLogSource lê eventos 307 exportados em XML (saída de "wevtutil qe /f:xml", com ou
+// sem elemento raiz <Events>, ou arquivos de eventos encaminhados).
+type eventXMLLogSource struct {
+	cfg            *SourceConfig
+	fileNameLayout string
+	location       *time.Location
+}
+
+// newEventXMLLogSource cria a fonte de eventos do PrintService.
+func newEventXMLLogSource(cfg *SourceConfig) (*eventXMLLogSource, error) {
+	src := &eventXMLLogSource{cfg: cfg, fileNameLayout: eventXMLFileNameLayout}
+	if cfg.FileNameLayout != "" {
+		src.fileNameLayout = cfg.FileNameLayout
+	}
+	location, err := loadSourceLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	src.location = location
+	if _, _, err := parseEncodingName(cfg.Encoding); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+func (s *eventXMLLogSource) Name() string {
+	if s.cfg.Name != "" {
+		return s.cfg.Name
+	}
+	return "Windows PrintService events"
+}
+
+func (s *eventXMLLogSource) Dir() string {
+	return s.cfg.PapercutLogDir
+}
+
+// DailyFile constrói o caminho do arquivo exportado do dia.
+func (s *eventXMLLogSource) DailyFile(day time.Time) string {
+	return filepath.Join(s.cfg.PapercutLogDir, day.Format(s.fileNameLayout))
+}
+
+// FileDay extrai a data do nome do arquivo. Um fileNameLayout sem data (arquivo único que
+// só cresce) não tem dia.
+func (s *eventXMLLogSource) FileDay(path string) (time.Time, bool) {
+	day, err := time.ParseInLocation(s.fileNameLayout, filepath.Base(path), time.Local)
+	if err != nil || day.Year() <= 1 {
+		return time.Time{}, false
+	}
+	return startOfDay(day), true
+}
+
+// Read processa os eventos completos (terminados em </Event>) a partir de currentOffset,
+// confirmando o offset logo após cada um. Um evento ainda sendo escrito fica para o próximo ciclo.
+func (s *eventXMLLogSource) Read(file *os.File, currentOffset int64, final bool, emit func(PrintData), commit func(offset int64) error) (int64, error) {
+	logPath := file.Name()
+
+	info, err := file.Stat()
+	if err != nil {
+		return currentOffset, fmt.Errorf("failed to stat log file '%s': %w", logPath, err)
+	}
+	fileSize := info.Size()
+	if currentOffset >= fileSize {
+		return currentOffset, nil // Nada novo desde o último ciclo
+	}
+	// Exportações redirecionadas pelo PowerShell costumam vir em UTF-16 com BOM
+	enc, bomLen, err := detectEncoding(file, s.cfg.Encoding)
+	if err != nil {
+		return currentOffset, err
+	}
+	start := currentOffset
+	if start < bomLen {
+		start = bomLen
+	}
+
+	// Marca o offset após cada '>', para que o fim de cada </Event> tenha offset exato mesmo
+	// quando os eventos são gravados sem quebra de linha entre eles.
+	section, err := newDecodedSection(file, enc, start, fileSize, '>')
+	if err != nil {
+		return currentOffset, err
+	}
+	text, err := io.ReadAll(section.reader)
+	if err != nil {
+		return currentOffset, fmt.Errorf("failed to read log file '%s': %w", logPath, err)
+	}
+
+	committedOffset := currentOffset
+	pos := 0
+	for {
+		begin := indexEventStart(text[pos:])
+		if begin < 0 {
+			break
+		}
+		begin += pos
+		end := bytes.Index(text[begin:], eventEndTag)
+		if end < 0 {
+			if final {
+				globalLogger.Println(fmt.Sprintf("WARNING: Skipping truncated event at the end of '%s' (offset %d).", logPath, committedOffset))
+			} else {
+				// Evento parcial: não avança o offset, ele será lido inteiro no próximo ciclo
+				globalLogger.Println(fmt.Sprintf("INFO: Last event of '%s' at offset %d is incomplete. Leaving it for the next cycle.", logPath, committedOffset))
+			}
+			break
+		}
+		end += begin + len(eventEndTag)
+
+		if printData, ok := s.parseEvent(text[begin:end], logPath); ok {
+			printData.JobID = recordJobID(logPath, committedOffset, text[begin:end])
+			emit(printData)
+		}
+
+		nextOffset := section.rawOffset(int64(end))
+		if err := commit(nextOffset); err != nil {
+			return committedOffset, err
+		}
+		committedOffset = nextOffset
+		pos = end
+	}
+
+	// Arquivos finais são marcados como lidos até o fim (ex: o </Events> de fechamento), para
+	// que a recuperação de dias anteriores não volte a abri-los.
+	if final && fileSize > committedOffset {
+		if err := commit(fileSize); err != nil {
+			return committedOffset, err
+		}
+		committedOffset = fileSize
+	}
+	return committedOffset, nil
+}
+
+// parseEvent converte um evento 307 em PrintData. Outros eventos são ignorados.
+func (s *eventXMLLogSource) parseEvent(raw []byte, sourceFile string) (PrintData, bool) {
+	var event printServiceEvent
+	if err := xml.Unmarshal(raw, &event); err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Skipping malformed event XML from '%s': %v", sourceFile, err))
+		return PrintData{}, false
+	}
+	if event.System.EventID != documentPrintedEventID {
+		return PrintData{}, false
+	}
+	if provider := event.System.Provider.Name; provider != "" && !strings.EqualFold(provider, printServiceProvider) {
+		return PrintData{}, false
+	}
+
+	// SystemTime é sempre UTC; data e hora são enviadas no fuso configurado
+	eventTime, err := time.Parse(time.RFC3339Nano, event.System.TimeCreated.SystemTime)
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not parse event time '%s' (record %d), skipping event: %v", event.System.TimeCreated.SystemTime, event.System.EventRecordID, err))
+		return PrintData{}, false
+	}
+	localTime := eventTime.In(s.location)
+
+	// Param1 job, Param2 documento, Param3 usuário, Param4 cliente, Param5 impressora,
+	// Param6 porta, Param7 tamanho em bytes, Param8 páginas
+	pagesStr := event.param(8)
+	paginas, err := strconv.Atoi(pagesStr)
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not parse pages '%s' to int, using 0: %v", pagesStr, err))
+		paginas = 0
+	}
+
+	documentName := event.param(2)
+	fileExtension := strings.TrimPrefix(filepath.Ext(documentName), ".")
+
+	// --- Capturar informações de rede ---
+	ip, mac, err := getNetworkInfo()
+	if err != nil {
+		globalLogger.Println(fmt.Sprintf("WARNING: Could not get network info: %v. IP and MAC will be empty.", err))
+	}
+
+	return PrintData{
+		Data:        localTime.Format("2006-01-02"),
+		Hora:        localTime.Format("15:04:05"),
+		Timestamp:   localTime.Format(time.RFC3339),
+		Usuario:     event.param(3),
+		Setor:       s.cfg.Setor,
+		Paginas:     paginas,
+		Copias:      1, // O evento 307 não informa cópias
+		Impressora:  event.param(5),
+		NomeArquivo: documentName,
+		Tipo:        fileExtension,
+		NomePC:      strings.TrimLeft(event.param(4), `\`), // Ex: "\\PC-JOAO"
+		Tamanho:     event.param(7),
+		IP:          ip,
+		MAC:         mac,
+		IDEmpresa:   s.cfg.IDEmpresa,
+	}, true
+}
+
+// indexEventStart localiza o próximo "<Event" que abre um evento (e não <EventID>, <Events>...).
+func indexEventStart(text []byte) int {
+	offset := 0
+	for {
+		i := bytes.Index(text[offset:], eventStartTag)
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		next := i + len(eventStartTag)
+		if next < len(text) {
+			switch text[next] {
+			case '>', ' ', '\t', '\r', '\n', '/':
+				return i
+			}
+		} else {
+			return i // Tag cortada no fim: tratada como evento parcial
+		}
+		offset = next
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	globalLogger = log.New(io.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// Evento 307 como sai do "wevtutil qe /f:xml": parâmetros em <UserData><DocumentPrinted>.
+const event307UserData = `<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event">
+  <System>
+    <Provider Name="Microsoft-Windows-PrintService" Guid="{747EF6FD-E535-4D16-B510-42C90F6873A1}"/>
+    <EventID>307</EventID>
+    <TimeCreated SystemTime="2024-03-05T13:04:05.1234567Z"/>
+    <EventRecordID>4242</EventRecordID>
+  </System>
+  <UserData>
+    <DocumentPrinted xmlns="http://manifests.microsoft.com/win/2005/08/windows/printing/spooler/core/events">
+      <Param1>17</Param1>
+      <Param2>Relatorio Mensal.pdf</Param2>
+      <Param3>joao.silva</Param3>
+      <Param4>\\PC-JOAO</Param4>
+      <Param5>HP Financeiro</Param5>
+      <Param6>IP_192.168.0.50</Param6>
+      <Param7>183456</Param7>
+      <Param8>12</Param8>
+    </DocumentPrinted>
+  </UserData>
+</Event>`
+
+// O mesmo evento encaminhado (Windows Event Forwarding): parâmetros em <EventData><Data Name>.
+const event307EventData = `<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event">
+  <System>
+    <Provider Name="Microsoft-Windows-PrintService"/>
+    <EventID>307</EventID>
+    <TimeCreated SystemTime="2024-03-05T13:04:05Z"/>
+    <EventRecordID>4243</EventRecordID>
+  </System>
+  <EventData>
+    <Data Name="Param1">18</Data>
+    <Data Name="Param2"> planilha.xlsx </Data>
+    <Data Name="Param3">maria</Data>
+    <Data Name="Param4">PC-MARIA</Data>
+    <Data Name="Param5">Brother RH</Data>
+    <Data Name="Param6">USB001</Data>
+    <Data Name="Param7">2048</Data>
+    <Data Name="Param8">3</Data>
+  </EventData>
+</Event>`
+
+func TestEventXMLParseEvent(t *testing.T) {
+	src, err := newEventXMLLogSource(&SourceConfig{TimeZone: "America/Sao_Paulo", Setor: "Financeiro", IDEmpresa: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		want PrintData
+	}{
+		{
+			name: "UserData",
+			raw:  event307UserData,
+			want: PrintData{
+				Data: "2024-03-05", Hora: "10:04:05", Timestamp: "2024-03-05T10:04:05-03:00",
+				Usuario: "joao.silva", Setor: "Financeiro", Paginas: 12, Copias: 1,
+				Impressora: "HP Financeiro", NomeArquivo: "Relatorio Mensal.pdf", Tipo: "pdf",
+				NomePC: "PC-JOAO", Tamanho: "183456", IDEmpresa: 2,
+			},
+		},
+		{
+			name: "EventData",
+			raw:  event307EventData,
+			want: PrintData{
+				Data: "2024-03-05", Hora: "10:04:05", Timestamp: "2024-03-05T10:04:05-03:00",
+				Usuario: "maria", Setor: "Financeiro", Paginas: 3, Copias: 1,
+				Impressora: "Brother RH", NomeArquivo: "planilha.xlsx", Tipo: "xlsx",
+				NomePC: "PC-MARIA", Tamanho: "2048", IDEmpresa: 2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := src.parseEvent([]byte(tt.raw), "printservice-2024-03-05.xml")
+			if !ok {
+				t.Fatal("event was skipped")
+			}
+			// IP e MAC vêm da máquina que roda o teste
+			got.IP, got.MAC = "", ""
+			if got != tt.want {
+				t.Errorf("parseEvent:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventXMLParseEventSkipsOtherEvents(t *testing.T) {
+	src, err := newEventXMLLogSource(&SourceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"other event ID": `<Event><System><Provider Name="Microsoft-Windows-PrintService"/><EventID>308</EventID>` +
+			`<TimeCreated SystemTime="2024-03-05T13:04:05Z"/></System></Event>`,
+		"other provider": `<Event><System><Provider Name="Other-Provider"/><EventID>307</EventID>` +
+			`<TimeCreated SystemTime="2024-03-05T13:04:05Z"/></System></Event>`,
+		"malformed": `<Event><System><EventID>307</EventID>`,
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := src.parseEvent([]byte(raw), "printservice-2024-03-05.xml"); ok {
+				t.Error("event was not skipped")
+			}
+		})
+	}
+}
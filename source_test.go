@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAPI faz o papel da API central, guardando o usuário de cada impressão recebida. Com
+// status diferente de zero, recusa os envios com ele; onRequest é chamado a cada envio.
+type testAPI struct {
+	mu        sync.Mutex
+	users     []string
+	status    int
+	onRequest func(PrintData)
+}
+
+func (a *testAPI) received() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.users...)
+}
+
+// setupLogPipeline prepara checkpoints, índice de jobs confirmados, fila de pendências e API em
+// um diretório temporário, e retorna a API com uma fonte printlogger lendo desse diretório.
+func setupLogPipeline(t *testing.T) (*testAPI, LogSource) {
+	t.Helper()
+	dir := t.TempDir()
+
+	api := &testAPI{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data PrintData
+		if r.URL.Path != "/central/receptprintreq" || json.NewDecoder(r.Body).Decode(&data) != nil {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		if api.onRequest != nil {
+			api.onRequest(data)
+		}
+		if api.status != 0 {
+			http.Error(w, "unavailable", api.status)
+			return
+		}
+		api.users = append(api.users, data.Usuario)
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	savedCheckpoints, savedAcked, savedEndpoints, savedBreaker := checkpoints, acked, apiEndpoints, apiBreaker
+	savedPending, savedDeadLetter := pendingDir, deadLetterDir
+	t.Cleanup(func() {
+		server.Close()
+		if acked != nil && acked.file != nil {
+			acked.file.Close()
+		}
+		checkpoints, acked, apiEndpoints, apiBreaker = savedCheckpoints, savedAcked, savedEndpoints, savedBreaker
+		pendingDir, deadLetterDir = savedPending, savedDeadLetter
+	})
+
+	var err error
+	if checkpoints, err = loadCheckpointStore(filepath.Join(dir, "checkpoints.json")); err != nil {
+		t.Fatal(err)
+	}
+	if acked, err = loadAckIndex(filepath.Join(dir, "acked.idx")); err != nil {
+		t.Fatal(err)
+	}
+	pendingDir, deadLetterDir = filepath.Join(dir, "pending"), filepath.Join(dir, "dead-letter")
+	for _, d := range []string{pendingDir, deadLetterDir, filepath.Join(dir, "logs")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apiBreaker = &circuitBreaker{state: breakerClosed}
+	setupAPIEndpoints(&Config{ApiBaseURLs: []string{server.URL}})
+
+	src, err := newCSVLogSource(&SourceConfig{Setor: "TI", PapercutLogDir: filepath.Join(dir, "logs")}, printLoggerSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api, src
+}
+
+// printLoggerLine monta uma linha do Print Logger impressa por user no dia day.
+func printLoggerLine(day time.Time, user string) string {
+	return day.Format("2006-01-02") + " 10:00:00," + user + ",1,1,HP,doc.pdf,pc-" + user + ",A4,PCL6,,,NOT DUPLEX,GRAYSCALE,10kb\n"
+}
+
+func appendFile(t *testing.T, path, content string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Um dia drenado antes de poder ser final (como ontem, dentro de finalizeGracePeriod) tem de
+// voltar a ser drenado mesmo depois que o arquivo de hoje ganhou checkpoint: a última linha
+// parcial e o que for escrito depois só chegam à API quando o dia é lido como final. O teste usa
+// anteontem, que já é sempre final, para não depender do horário em que roda.
+func TestProcessLogSourceFinalizesEarlierDay(t *testing.T) {
+	api, src := setupLogPipeline(t)
+	today := startOfDay(time.Now())
+	earlier := today.AddDate(0, 0, -2)
+	earlierPath, todayPath := src.DailyFile(earlier), src.DailyFile(today)
+
+	partial := printLoggerLine(earlier, "caio")
+	appendFile(t, earlierPath, printLoggerHeader+printLoggerLine(earlier, "ana")+printLoggerLine(earlier, "bia")+partial[:len(partial)-1])
+	if err := processLogFile(&Config{}, src, earlierPath, false); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, todayPath, printLoggerHeader+printLoggerLine(today, "duda"))
+	if err := processLogFile(&Config{}, src, todayPath, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := api.received(), []string{"ana", "bia", "duda"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("before rollover: got %v, want %v", got, want)
+	}
+
+	// O PaperCut termina a linha e acrescenta outra, sem '\n', depois que o dia virou
+	last := printLoggerLine(earlier, "eva")
+	appendFile(t, earlierPath, "\n"+last[:len(last)-1])
+	for i := 0; i < 2; i++ {
+		if err := processLogSource(&Config{}, src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := api.received(), []string{"ana", "bia", "duda", "caio", "eva"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after rollover: got %v, want %v", got, want)
+	}
+	info, _ := os.Stat(earlierPath)
+	if cp, _ := checkpoints.Get(earlierPath); !cp.Final || cp.Offset != info.Size() {
+		t.Errorf("earlier day checkpoint %+v is not finalized at size %d", cp, info.Size())
+	}
+	if day, _ := catchUpStartDay(src); !day.Equal(today) {
+		t.Errorf("catch-up starts at %s, want today", day.Format("2006-01-02"))
+	}
+}
+
+// Cada passo grava no arquivo diário, roda uma passagem de processLogFile e confere o que chegou
+// à API nela. restart recarrega os checkpoints do disco antes da passagem, como um reinício do
+// serviço (ou uma queda) faria.
+func TestProcessLogFile(t *testing.T) {
+	day := startOfDay(time.Now()).AddDate(0, 0, -2)
+	line := func(user string) string { return printLoggerLine(day, user) }
+	type step struct {
+		write   string // Acrescentado ao arquivo
+		replace bool   // write substitui o arquivo em vez de ser acrescentado
+		final   bool
+		restart bool
+		want    []string
+		wantErr bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "resume from checkpoint",
+			steps: []step{
+				{write: printLoggerHeader + line("ana") + line("bia"), want: []string{"ana", "bia"}},
+				{write: line("caio"), restart: true, want: []string{"caio"}},
+				{restart: true},
+			},
+		},
+		{
+			name: "partial trailing line",
+			steps: []step{
+				{write: printLoggerHeader + line("ana") + line("bia")[:20], want: []string{"ana"}},
+				{restart: true},
+				{write: line("bia")[20:], want: []string{"bia"}},
+			},
+		},
+		{
+			name: "partial trailing line in a final file",
+			steps: []step{
+				{write: printLoggerHeader + line("ana") + strings.TrimSuffix(line("bia"), "\n"), final: true, want: []string{"ana", "bia"}},
+				{final: true},
+			},
+		},
+		{
+			name: "truncated file",
+			steps: []step{
+				{write: printLoggerHeader + line("ana") + line("bia"), want: []string{"ana", "bia"}},
+				{write: printLoggerHeader + line("caio"), replace: true, want: []string{"caio"}},
+			},
+		},
+		{
+			name: "replaced file",
+			steps: []step{
+				{write: printLoggerHeader + line("ana"), want: []string{"ana"}},
+				{write: "PaperCut Print Logger\n" + printLoggerHeader + line("caio") + line("duda"), replace: true, want: []string{"caio", "duda"}},
+			},
+		},
+		{
+			name: "header still being written",
+			steps: []step{
+				{write: printLoggerHeader[:20]},
+				{write: printLoggerHeader[20:] + line("ana"), want: []string{"ana"}},
+			},
+		},
+		{
+			name: "bad header",
+			steps: []step{
+				{write: "Foo,Bar\n1,2\n", wantErr: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, src := setupLogPipeline(t)
+			path := src.DailyFile(day)
+			seen := 0
+			for i, st := range tt.steps {
+				if st.replace {
+					os.Remove(path)
+				}
+				appendFile(t, path, st.write)
+				if st.restart {
+					store, err := loadCheckpointStore(checkpoints.path)
+					if err != nil {
+						t.Fatal(err)
+					}
+					checkpoints = store
+				}
+
+				err := processLogFile(&Config{}, src, path, st.final)
+				if (err != nil) != st.wantErr {
+					t.Fatalf("step %d: got error %v, want error %v", i, err, st.wantErr)
+				}
+				received := api.received()
+				if got := received[seen:]; len(got) != len(st.want) || (len(got) > 0 && !reflect.DeepEqual(got, st.want)) {
+					t.Errorf("step %d: API received %v, want %v", i, got, st.want)
+				}
+				seen = len(received)
+			}
+		})
+	}
+}
+
+// Um registro que foi para a fila de pendências não está no índice de jobs confirmados, então o
+// checkpoint dele tem de estar em disco antes do próximo registro: uma queda no meio da leitura
+// não pode enfileirá-lo de novo.
+func TestProcessLogFileSavesQueuedRecordsAtOnce(t *testing.T) {
+	api, src := setupLogPipeline(t)
+	day := startOfDay(time.Now()).AddDate(0, 0, -2)
+	path := src.DailyFile(day)
+	users := []string{"ana", "bia", "caio"}
+	content := printLoggerHeader
+	var want []int64 // Checkpoint que deve estar em disco quando cada registro é enviado
+	for _, user := range users {
+		want = append(want, int64(len(content)))
+		content += printLoggerLine(day, user)
+	}
+	want[0] = 0 // Antes do primeiro registro, nem o fim do cabeçalho precisa estar gravado
+	appendFile(t, path, content)
+
+	var saved []int64
+	api.status = http.StatusServiceUnavailable
+	api.onRequest = func(PrintData) {
+		store, err := loadCheckpointStore(checkpoints.path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		cp, _ := store.Get(path)
+		saved = append(saved, cp.Offset)
+	}
+	if err := processLogFile(&Config{}, src, path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(saved, want) {
+		t.Errorf("checkpoint on disk when each record was sent: %v, want %v", saved, want)
+	}
+	if queued, _ := os.ReadDir(pendingDir); len(queued) != len(users) {
+		t.Errorf("got %d queued record(s), want %d", len(queued), len(users))
+	}
+}